@@ -0,0 +1,223 @@
+package main
+
+import (
+	"HW3/ivy"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const adminTimeout = 2 * time.Second
+
+func runAdmin(args []string) error {
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	configPath := flags.String("config", "cluster.json", "cluster config file")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: ivy admin [flags] status | pages | page N | policy N invalidate|update")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	config, err := ivy.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	transport := ivy.NewTCPTransport()
+
+	switch flags.Arg(0) {
+	case "status":
+		return adminStatus(config, transport)
+	case "pages":
+		return adminPages(config, transport)
+	case "page":
+		pageNum, err := strconv.Atoi(flags.Arg(1))
+		if err != nil {
+			return fmt.Errorf("invalid page number %q", flags.Arg(1))
+		}
+		return adminPage(config, transport, pageNum)
+	case "policy":
+		pageNum, err := strconv.Atoi(flags.Arg(1))
+		if err != nil {
+			return fmt.Errorf("invalid page number %q", flags.Arg(1))
+		}
+		return adminPolicy(config, transport, pageNum, flags.Arg(2))
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown admin command %q", flags.Arg(0))
+	}
+}
+
+// cmIds returns the ids of the configured CMs in ascending order
+func cmIds(config *ivy.ClusterConfig) []int {
+	ids := []int{}
+	for _, cm := range config.CMs {
+		ids = append(ids, cm.Id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// adminStatus prints the role of every CM, or how many pages every node manages if the nodes manage them
+func adminStatus(config *ivy.ClusterConfig, transport ivy.Transport) error {
+	if config.Manager == ivy.ManagerDynamic {
+		nodeAddr := config.NodeAddrs()
+		for _, id := range config.Managers() {
+			res := &ivy.ListPagesResponse{}
+			err := transport.Call(nodeAddr[id], "Node.OwnedPages", &ivy.ListPagesArgs{}, res, adminTimeout)
+			if err != nil {
+				fmt.Printf("Node %d at %s: unreachable (%s)\n", id, nodeAddr[id], err)
+			} else {
+				fmt.Printf("Node %d at %s: owns %d pages\n", id, nodeAddr[id], len(res.Pages))
+			}
+		}
+		return nil
+	}
+	if config.NodesManage() {
+		nodeAddr := config.NodeAddrs()
+		for _, id := range config.Managers() {
+			res := &ivy.ListPagesResponse{}
+			err := transport.Call(nodeAddr[id], "CentralManager.ListPages", &ivy.ListPagesArgs{}, res, adminTimeout)
+			if err != nil {
+				fmt.Printf("Node %d at %s: unreachable (%s)\n", id, nodeAddr[id], err)
+			} else {
+				fmt.Printf("Node %d at %s: manages %d pages\n", id, nodeAddr[id], len(res.Pages))
+			}
+		}
+		return nil
+	}
+	CMaddr := config.CMAddrs()
+	for _, id := range cmIds(config) {
+		res := &ivy.StatusResponse{}
+		err := transport.Call(CMaddr[id], "CentralManager.Status", &ivy.StatusArgs{}, res, adminTimeout)
+		if err != nil {
+			fmt.Printf("CM %d at %s: unreachable (%s)\n", id, CMaddr[id], err)
+		} else if res.IsPrimary {
+			fmt.Printf("CM %d at %s: primary\n", id, CMaddr[id])
+		} else {
+			fmt.Printf("CM %d at %s: backup of CM %d\n", id, CMaddr[id], res.PrimaryId)
+		}
+	}
+	return nil
+}
+
+// findPrimary returns the address of the CM that is currently the primary
+func findPrimary(config *ivy.ClusterConfig, transport ivy.Transport) (string, error) {
+	CMaddr := config.CMAddrs()
+	for _, id := range cmIds(config) {
+		res := &ivy.StatusResponse{}
+		err := transport.Call(CMaddr[id], "CentralManager.Status", &ivy.StatusArgs{}, res, adminTimeout)
+		if err == nil && res.IsPrimary {
+			return CMaddr[id], nil
+		}
+	}
+	return "", errors.New("no primary CM is reachable")
+}
+
+// adminPages prints what the primary CM has on record for every page, or every node for the pages
+// it manages or owns
+func adminPages(config *ivy.ClusterConfig, transport ivy.Transport) error {
+	if config.Manager == ivy.ManagerDynamic {
+		pages, err := ivy.ListOwnedPages(transport, config.NodeAddrs())
+		if err != nil {
+			return err
+		}
+		for _, info := range pages {
+			printPageInfo(info)
+		}
+		return nil
+	}
+	if config.NodesManage() {
+		nodeAddr := config.NodeAddrs()
+		pages := []ivy.PageInfoResponse{}
+		for _, id := range config.Managers() {
+			res := &ivy.ListPagesResponse{}
+			err := transport.Call(nodeAddr[id], "CentralManager.ListPages", &ivy.ListPagesArgs{}, res, adminTimeout)
+			if err != nil {
+				return fmt.Errorf("node %d: %w", id, err)
+			}
+			pages = append(pages, res.Pages...)
+		}
+		sort.Slice(pages, func(i, j int) bool { return pages[i].PageNum < pages[j].PageNum })
+		for _, info := range pages {
+			printPageInfo(info)
+		}
+		return nil
+	}
+	primary, err := findPrimary(config, transport)
+	if err != nil {
+		return err
+	}
+	res := &ivy.ListPagesResponse{}
+	err = transport.Call(primary, "CentralManager.ListPages", &ivy.ListPagesArgs{}, res, adminTimeout)
+	if err != nil {
+		return err
+	}
+	for _, info := range res.Pages {
+		printPageInfo(info)
+	}
+	return nil
+}
+
+// adminPage prints what the manager of a page, the primary CM or a node, has on record for it. Under
+// the dynamic distributed manager it follows the probable owners from the node that allocates the page
+func adminPage(config *ivy.ClusterConfig, transport ivy.Transport, pageNum int) error {
+	if config.Manager == ivy.ManagerDynamic {
+		info, err := ivy.FindOwner(transport, config.NodeAddrs(), config.PageManager(pageNum), pageNum)
+		if err != nil {
+			return err
+		}
+		printPageInfo(*info)
+		return nil
+	}
+	var manager string
+	if config.NodesManage() {
+		manager = config.NodeAddrs()[config.PageManager(pageNum)]
+	} else {
+		primary, err := findPrimary(config, transport)
+		if err != nil {
+			return err
+		}
+		manager = primary
+	}
+	res := &ivy.PageInfoResponse{}
+	err := transport.Call(manager, "CentralManager.PageInfo", &ivy.PageInfoArgs{PageNum: pageNum}, res, adminTimeout)
+	if err != nil {
+		return err
+	}
+	printPageInfo(*res)
+	return nil
+}
+
+// adminPolicy changes the coherence policy of a page at its manager, the primary CM or a node
+func adminPolicy(config *ivy.ClusterConfig, transport ivy.Transport, pageNum int, policy string) error {
+	if config.Manager == ivy.ManagerDynamic {
+		return fmt.Errorf("pages have no policy under the %s manager", ivy.ManagerDynamic)
+	}
+	var manager string
+	if config.NodesManage() {
+		manager = config.NodeAddrs()[config.PageManager(pageNum)]
+	} else {
+		primary, err := findPrimary(config, transport)
+		if err != nil {
+			return err
+		}
+		manager = primary
+	}
+	err := transport.Call(manager, "CentralManager.SetPolicy", &ivy.SetPolicyArgs{PageNum: pageNum, Policy: policy}, &ivy.SetPolicyResponse{}, adminTimeout)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Page %d: policy %s\n", pageNum, policy)
+	return nil
+}
+
+func printPageInfo(info ivy.PageInfoResponse) {
+	policy := ""
+	if info.Policy != "" {
+		policy = ", policy " + info.Policy
+	}
+	fmt.Printf("Page %d: owner %d, copyset %v, %d waiting%s\n", info.PageNum, info.Owner, info.CopySet, info.Waiting, policy)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"HW3/ivy"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runBench runs the benchmark for every combination of the node counts, page counts, write ratios
+// and policies given, and writes one row per run to --csv and --json for plotting
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	nodes := flags.String("nodes", "4", "comma separated node counts to run")
+	pages := flags.String("pages", "16", "comma separated page counts to run")
+	writes := flags.String("writes", "0.1,0.5,0.9", "comma separated write ratios to run")
+	ops := flags.Int("ops", 500, "operations per node")
+	duration := flags.Duration("duration", 0, "run every configuration for this long instead of --ops operations per node")
+	pattern := flags.String("pattern", "uniform", "page access pattern, uniform or hotspot")
+	hotPages := flags.Float64("hot-pages", 0.2, "fraction of the pages that are hot, for the hotspot pattern")
+	hotRatio := flags.Float64("hot-ratio", 0.8, "fraction of the operations that go to hot pages, for the hotspot pattern")
+	failCM := flags.Duration("fail-cm", 0, "stop the primary CM this long into every run, 0 keeps it running")
+	seed := flags.Int64("seed", 1, "seed of the random operations")
+	port := flags.Int("tcp-port", 0, "run over TCP on localhost from this port instead of in memory")
+	csvFile := flags.String("csv", "", "file to write the results to as CSV")
+	jsonFile := flags.String("json", "", "file to write the results to as JSON")
+	verbose := flags.Bool("v", false, "print the log of the nodes and the CMs")
+	manager := flags.String("manager", ivy.ManagerCentral, "central runs CMs, fixed or dynamic has the nodes manage the pages")
+	policies := flags.String("policy", ivy.PolicyInvalidate, "comma separated coherence policies to run, invalidate or update")
+	flags.Parse(args)
+
+	if !*verbose {
+		ivy.SetLogOutput(io.Discard, "text")
+	}
+	nodeCounts, err := parseInts(*nodes)
+	if err != nil {
+		return fmt.Errorf("--nodes: %w", err)
+	}
+	pageCounts, err := parseInts(*pages)
+	if err != nil {
+		return fmt.Errorf("--pages: %w", err)
+	}
+	writeRatios, err := parseFloats(*writes)
+	if err != nil {
+		return fmt.Errorf("--writes: %w", err)
+	}
+	for _, w := range writeRatios {
+		if err := ivy.CheckFraction("--writes", w); err != nil {
+			return err
+		}
+	}
+	if err := ivy.CheckFraction("--hot-pages", *hotPages); err != nil {
+		return err
+	}
+	if err := ivy.CheckFraction("--hot-ratio", *hotRatio); err != nil {
+		return err
+	}
+
+	results := []ivy.BenchResult{}
+	fmt.Printf("%5s %5s %6s %10s %6s %6s %10s %8s %6s %6s %6s %10s %10s %10s %10s\n",
+		"nodes", "pages", "writes", "policy", "ops", "errors", "ops/s", "msgs/op", "faults", "invals", "updates", "fault avg", "fault p50", "fault p99", "max")
+	for _, n := range nodeCounts {
+		for _, p := range pageCounts {
+			for _, w := range writeRatios {
+				for _, policy := range strings.Split(*policies, ",") {
+					config := ivy.BenchConfig{
+						Nodes:       n,
+						Pages:       p,
+						OpsPerNode:  *ops,
+						Duration:    *duration,
+						WriteRatio:  w,
+						Pattern:     *pattern,
+						HotPages:    *hotPages,
+						HotRatio:    *hotRatio,
+						FailCMAfter: *failCM,
+						Seed:        *seed,
+						BasePort:    *port,
+						Manager:     *manager,
+						Policy:      strings.TrimSpace(policy),
+					}
+					result, err := ivy.RunBench(config)
+					if err != nil {
+						return err
+					}
+					results = append(results, result)
+
+					max := result.Reads.Max
+					if result.Writes.Max > max {
+						max = result.Writes.Max
+					}
+					fmt.Printf("%5d %5d %6.2f %10s %6d %6d %10.0f %8.2f %6d %6d %6d %10s %10s %10s %10s\n",
+						n, p, w, config.Policy, result.Ops, result.Errors, result.Throughput, result.MessagesPerOp,
+						result.Faults.Count, result.Invalidations, result.Updates,
+						roundDuration(result.Faults.Mean), roundDuration(result.Faults.P50), roundDuration(result.Faults.P99), roundDuration(max))
+				}
+			}
+		}
+	}
+
+	if *csvFile != "" {
+		if err := writeBenchCSV(*csvFile, results); err != nil {
+			return err
+		}
+	}
+	if *jsonFile != "" {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(*jsonFile, data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBenchCSV writes one row per run, with latencies in milliseconds
+func writeBenchCSV(path string, results []ivy.BenchResult) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	header := []string{"nodes", "pages", "write_ratio", "pattern", "policy", "fail_cm_after_s", "ops", "errors",
+		"elapsed_s", "ops_per_second", "messages_per_op", "invalidations", "updates"}
+	for _, kind := range []string{"read", "write", "fault"} {
+		for _, stat := range []string{"count", "mean_ms", "p50_ms", "p90_ms", "p99_ms", "max_ms"} {
+			header = append(header, kind+"_"+stat)
+		}
+	}
+	w.Write(header)
+
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	for _, result := range results {
+		config := result.Config
+		row := []string{
+			strconv.Itoa(config.Nodes),
+			strconv.Itoa(config.Pages),
+			strconv.FormatFloat(config.WriteRatio, 'f', -1, 64),
+			config.Pattern,
+			config.Policy,
+			strconv.FormatFloat(config.FailCMAfter.Seconds(), 'f', -1, 64),
+			strconv.Itoa(result.Ops),
+			strconv.Itoa(result.Errors),
+			strconv.FormatFloat(result.Elapsed.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(result.Throughput, 'f', 1, 64),
+			strconv.FormatFloat(result.MessagesPerOp, 'f', 3, 64),
+			strconv.FormatInt(result.Invalidations, 10),
+			strconv.FormatInt(result.Updates, 10),
+		}
+		for _, stats := range []ivy.LatencyStats{result.Reads, result.Writes, result.Faults} {
+			row = append(row, strconv.Itoa(stats.Count), ms(stats.Mean), ms(stats.P50), ms(stats.P90), ms(stats.P99), ms(stats.Max))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
+
+func parseInts(list string) ([]int, error) {
+	values := []int{}
+	for _, field := range strings.Split(list, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func parseFloats(list string) ([]float64, error) {
+	values := []float64{}
+	for _, field := range strings.Split(list, ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"HW3/ivy"
+	"flag"
+	"fmt"
+)
+
+// runCheck checks the histories written with --history by the nodes of a run. The clocks of the
+// nodes are compared for linearizability, so they should be in sync, or on one machine. The pages
+// start out with the contents in the cluster config of the run, or empty without one
+func runCheck(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	model := flags.String("model", ivy.Sequential, "consistency model, sequential or linearizable")
+	configPath := flags.String("config", "", "cluster config file of the run, for the initial page contents")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: ivy check [--model sequential|linearizable] [--config cluster.json] file...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no history files given")
+	}
+	initial := map[int]string{}
+	if *configPath != "" {
+		config, err := ivy.LoadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		initial = config.InitialContents()
+	}
+	operations, err := ivy.LoadHistory(flags.Args())
+	if err != nil {
+		return err
+	}
+	results, err := ivy.CheckHistory(operations, initial, *model)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, result := range results {
+		fmt.Println(result)
+		if !result.Ok {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d pages are not %s", failed, len(results), *model)
+	}
+	fmt.Printf("all %d pages are %s\n", len(results), *model)
+	return nil
+}
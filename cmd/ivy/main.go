@@ -0,0 +1,203 @@
+package main
+
+import (
+	"HW3/ivy"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+const usage = `usage: ivy <command> [flags]
+
+commands:
+  cm      run a central manager            ivy cm --id 0
+  node    run a node with its REPL         ivy node --id 1, ivy node --join --listen host:port
+  admin   query a running cluster          ivy admin status | pages | page N
+  sim     run the protocol in simulation   ivy sim --runs 100
+  trace   merge the trace files of a run   ivy trace -o run.json cm0.json node1.json node2.json
+  bench   measure latency and throughput   ivy bench --nodes 2,4,8 --writes 0.1,0.5 --csv out.csv
+  check   check recorded histories         ivy check --model sequential node1.jsonl node2.jsonl
+
+run ivy <command> -h for the flags of a command
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "cm":
+		err = runCM(os.Args[2:])
+	case "node":
+		err = runNode(os.Args[2:])
+	case "admin":
+		err = runAdmin(os.Args[2:])
+	case "sim":
+		err = runSim(os.Args[2:])
+	case "trace":
+		err = runTrace(os.Args[2:])
+	case "bench":
+		err = runBench(os.Args[2:])
+	case "check":
+		err = runCheck(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Printf("unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+// commonFlags are the flags shared by the cm and node commands
+type commonFlags struct {
+	config    *string
+	id        *int
+	listen    *string
+	logLevel  *string
+	logFile   *string
+	logFormat *string
+	metrics   *string
+	traceFile *string
+}
+
+func addCommonFlags(flags *flag.FlagSet, defaultId int) commonFlags {
+	return commonFlags{
+		config:    flags.String("config", "cluster.json", "cluster config file"),
+		id:        flags.Int("id", defaultId, "id of this process in the config"),
+		listen:    flags.String("listen", "", "address to listen on instead of the one in the config"),
+		logLevel:  flags.String("log-level", "info", "debug, info, warn or error"),
+		logFile:   flags.String("log-file", "", "file to append the log to instead of stderr"),
+		logFormat: flags.String("log-format", "text", "text or json"),
+		metrics:   flags.String("metrics", "", "address to serve Prometheus metrics on at /metrics, e.g. localhost:9100"),
+		traceFile: flags.String("trace-file", "", "file to record a Chrome trace of every request hop in, see ivy trace"),
+	}
+}
+
+// load sets up the log and reads the cluster config
+func (common commonFlags) load() (*ivy.ClusterConfig, error) {
+	if err := ivy.SetLogLevel(*common.logLevel); err != nil {
+		return nil, err
+	}
+	var output io.Writer = os.Stderr
+	if *common.logFile != "" {
+		// the file stays open until the process exits
+		file, err := os.OpenFile(*common.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		output = file
+	}
+	if err := ivy.SetLogOutput(output, *common.logFormat); err != nil {
+		return nil, err
+	}
+	return ivy.LoadConfig(*common.config)
+}
+
+func runCM(args []string) error {
+	flags := flag.NewFlagSet("cm", flag.ExitOnError)
+	common := addCommonFlags(flags, 0)
+	wal := flags.String("wal", "", "directory for the CM's write-ahead log instead of the one in the config")
+	flags.Parse(args)
+
+	config, err := common.load()
+	if err != nil {
+		return err
+	}
+	if config.NodesManage() {
+		return fmt.Errorf("the nodes manage the pages in %s, there is no CM to run", *common.config)
+	}
+	if !config.HasCM(*common.id) {
+		return fmt.Errorf("CM %d is not in %s", *common.id, *common.config)
+	}
+
+	CMaddr := config.CMAddrs()
+	if *common.listen != "" {
+		CMaddr[*common.id] = *common.listen
+	}
+	if *wal == "" {
+		*wal = config.CMWAL(*common.id)
+	}
+	// the configured primary takes its role back when it is restarted
+	ivy.RegisterCM(ivy.CMOptions{
+		Id:             *common.id,
+		NodeAddr:       config.NodeAddrs(),
+		PageRecords:    config.PageRecords(),
+		CMAddr:         CMaddr,
+		PrimaryId:      config.Primary,
+		ReclaimPrimary: *common.id == config.Primary,
+		WALDir:         *wal,
+		MetricsAddr:    *common.metrics,
+		TraceFile:      *common.traceFile,
+	})
+	return nil
+}
+
+func runNode(args []string) error {
+	flags := flag.NewFlagSet("node", flag.ExitOnError)
+	common := addCommonFlags(flags, 1)
+	join := flags.Bool("join", false, "join as a new node that is not in the config, the CM picks its id. Needs --listen")
+	store := flags.String("store", "", "directory to keep the node's pages in across restarts instead of the one in the config")
+	history := flags.String("history", "", "file to record every read and write of the REPL in, see ivy check")
+	flags.Parse(args)
+
+	config, err := common.load()
+	if err != nil {
+		return err
+	}
+
+	nodeAddr := config.NodeAddrs()
+	if *join {
+		if *common.listen == "" {
+			return fmt.Errorf("--join needs --listen")
+		}
+		if config.NodesManage() {
+			return fmt.Errorf("nodes cannot join when they manage the pages")
+		}
+		ivy.NodeStart(ivy.NodeOptions{
+			CurrentCM:   config.Primary,
+			CMAddr:      config.CMAddrs(),
+			NodeAddr:    nodeAddr,
+			Pages:       []*ivy.Page{},
+			Address:     *common.listen,
+			StoreDir:    *store,
+			MetricsAddr: *common.metrics,
+			TraceFile:   *common.traceFile,
+			HistoryFile: *history,
+		})
+		return nil
+	}
+
+	if !config.HasNode(*common.id) {
+		return fmt.Errorf("node %d is not in %s", *common.id, *common.config)
+	}
+	if *common.listen != "" {
+		nodeAddr[*common.id] = *common.listen
+	}
+	if *store == "" {
+		*store = config.NodeStore(*common.id)
+	}
+	ivy.NodeStart(ivy.NodeOptions{
+		Id:          *common.id,
+		CurrentCM:   config.Primary,
+		CMAddr:      config.CMAddrs(),
+		NodeAddr:    nodeAddr,
+		Pages:       config.NodePages(*common.id),
+		Address:     nodeAddr[*common.id],
+		StoreDir:    *store,
+		MetricsAddr: *common.metrics,
+		TraceFile:   *common.traceFile,
+		HistoryFile: *history,
+		Manager:     config.Manager,
+		Managers:    config.Managers(),
+		PageRecords: config.PageRecords(),
+	})
+	return nil
+}
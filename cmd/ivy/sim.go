@@ -0,0 +1,66 @@
+package main
+
+import (
+	"HW3/ivy"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// runSim runs the protocol under the simulator for a range of seeds. A failing seed can be
+// replayed with --seed N --runs 1 --trace to see every event of the run
+func runSim(args []string) error {
+	flags := flag.NewFlagSet("sim", flag.ExitOnError)
+	seed := flags.Int64("seed", 1, "seed of the first run")
+	runs := flags.Int("runs", 100, "number of seeds to run, starting at --seed")
+	nodes := flags.Int("nodes", 3, "number of nodes")
+	pages := flags.Int("pages", 2, "number of pages")
+	ops := flags.Int("ops", 20, "operations per node")
+	writes := flags.Float64("writes", 0.5, "fraction of operations that are writes")
+	delay := flags.Duration("delay", 50*time.Millisecond, "maximum message delay")
+	loss := flags.Float64("loss", 0, "fraction of messages that are lost")
+	steps := flags.Int("steps", 100000, "maximum number of events in a run")
+	trace := flags.Bool("trace", false, "print every event")
+	verbose := flags.Bool("v", false, "print the log of the nodes and the CM")
+	manager := flags.String("manager", ivy.ManagerCentral, "central runs a CM, fixed or dynamic has the nodes manage the pages")
+	policy := flags.String("policy", ivy.PolicyInvalidate, "coherence policy of every page, invalidate or update")
+	flags.Parse(args)
+
+	if !*verbose {
+		ivy.SetLogOutput(io.Discard, "text")
+	}
+
+	failed := 0
+	for i := 0; i < *runs; i++ {
+		config := ivy.SimConfig{
+			Seed:       *seed + int64(i),
+			Nodes:      *nodes,
+			Pages:      *pages,
+			OpsPerNode: *ops,
+			WriteRatio: *writes,
+			MaxDelay:   *delay,
+			LossRate:   *loss,
+			MaxSteps:   *steps,
+			Manager:    *manager,
+			Policy:     *policy,
+		}
+		if *trace {
+			config.Trace = os.Stderr
+		}
+
+		result := ivy.RunSim(config)
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "seed %d: FAILED after %d steps, %s virtual: %s\n", result.Seed, result.Steps, result.VirtualTime, result.Err)
+		} else {
+			fmt.Fprintf(os.Stderr, "seed %d: ok, %d ops (%d failed) in %d steps, %s virtual\n", result.Seed, result.Ops, result.Failed, result.Steps, result.VirtualTime)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d runs failed", failed, *runs)
+	}
+	fmt.Fprintf(os.Stderr, "all %d runs passed\n", *runs)
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"HW3/ivy"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runTrace merges the trace files written with --trace-file by the CMs and nodes of a run into one
+// file, where every hop of a request can be followed across the processes
+func runTrace(args []string) error {
+	flags := flag.NewFlagSet("trace", flag.ExitOnError)
+	output := flags.String("o", "trace.json", "file to write the merged trace to")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: ivy trace [-o out.json] file...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no trace files given")
+	}
+	data, err := ivy.MergeTraces(flags.Args())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, data, 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s, open it in chrome://tracing or ui.perfetto.dev\n", *output)
+	return nil
+}
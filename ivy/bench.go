@@ -0,0 +1,294 @@
+package ivy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BenchConfig describes one benchmark run: a cluster of CMs and nodes in this process, and the
+// operations every node performs on the pages
+type BenchConfig struct {
+	Nodes       int
+	Pages       int
+	OpsPerNode  int           // operations every node performs, unless Duration is set
+	Duration    time.Duration // if not 0, nodes keep going until this much time has passed
+	WriteRatio  float64       // fraction of operations that are writes
+	Pattern     string        // "uniform" picks pages evenly, "hotspot" sends HotRatio of the operations to HotPages of the pages
+	HotPages    float64
+	HotRatio    float64
+	FailCMAfter time.Duration // if not 0, the primary CM is stopped this long into the run and the backup takes over
+	Seed        int64
+	BasePort    int    // 0 runs the cluster over MemTransport, otherwise over TCP on localhost from this port
+	Manager     string // ManagerCentral runs CMs, ManagerFixed and ManagerDynamic have the nodes manage the pages
+	Policy      string // coherence policy of every page, PolicyInvalidate or PolicyUpdate
+}
+
+// LatencyStats summarizes the latencies of a set of operations
+type LatencyStats struct {
+	Count int           `json:"count"`
+	Mean  time.Duration `json:"mean_ns"`
+	P50   time.Duration `json:"p50_ns"`
+	P90   time.Duration `json:"p90_ns"`
+	P99   time.Duration `json:"p99_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+type BenchResult struct {
+	Config        BenchConfig   `json:"config"`
+	Ops           int           `json:"ops"`    // operations that completed
+	Errors        int           `json:"errors"` // operations that failed
+	Elapsed       time.Duration `json:"elapsed_ns"`
+	Throughput    float64       `json:"ops_per_second"`
+	Messages      int64         `json:"messages"` // RPC calls made by the CMs and nodes, a call and its reply count once
+	MessagesPerOp float64       `json:"messages_per_op"`
+	Invalidations int64         `json:"invalidations"` // of the messages, the invalidations sent before writes
+	Updates       int64         `json:"updates"`       // of the messages, the updates pushed to copies under the update policy
+	Reads         LatencyStats  `json:"reads"`
+	Writes        LatencyStats  `json:"writes"`
+	Faults        LatencyStats  `json:"faults"` // the reads and writes that could not be served locally
+}
+
+// countingTransport counts the calls made through a Transport
+type countingTransport struct {
+	Transport
+	calls         atomic.Int64
+	invalidations atomic.Int64
+	updates       atomic.Int64
+}
+
+func (transport *countingTransport) Call(address string, method string, args any, reply any, timeout time.Duration) error {
+	transport.calls.Add(1)
+	if method == "Node.Invalidate" {
+		transport.invalidations.Add(1)
+	} else if method == "Node.UpdatePage" {
+		transport.updates.Add(1)
+	}
+	return transport.Transport.Call(address, method, args, reply, timeout)
+}
+
+// RunBench runs a benchmark. Pages start out spread over the nodes, and with FailCMAfter set there
+// are two CMs so that the cluster survives losing the primary
+func RunBench(config BenchConfig) (BenchResult, error) {
+	result := BenchResult{Config: config}
+	if config.Nodes < 1 || config.Pages < 1 {
+		return result, fmt.Errorf("need at least one node and one page")
+	}
+	if config.Pattern != "uniform" && config.Pattern != "hotspot" {
+		return result, fmt.Errorf("unknown access pattern %q, expected uniform or hotspot", config.Pattern)
+	}
+	if err := CheckFraction("hot pages", config.HotPages); err != nil {
+		return result, err
+	}
+	if err := CheckFraction("hot ratio", config.HotRatio); err != nil {
+		return result, err
+	}
+	if err := checkPolicy(config.Manager, config.Policy); err != nil {
+		return result, err
+	}
+	if nodesManage(config.Manager) && config.FailCMAfter > 0 {
+		return result, fmt.Errorf("there is no CM to fail when the nodes manage the pages")
+	}
+
+	transport := &countingTransport{}
+	address := func(i int) string { return "bench" + strconv.Itoa(i) }
+	if config.BasePort == 0 {
+		transport.Transport = NewMemTransport()
+	} else {
+		tcp := NewTCPTransport()
+		// closed last, so that the next run on the same ports does not reach this run's nodes
+		// over connections left in the pool
+		defer tcp.Close()
+		transport.Transport = tcp
+		address = func(i int) string { return "localhost:" + strconv.Itoa(config.BasePort+i) }
+	}
+
+	numCMs := 1
+	if config.FailCMAfter > 0 {
+		numCMs = 2
+	} else if nodesManage(config.Manager) {
+		numCMs = 0
+	}
+	CMaddr := map[int]string{}
+	for i := 0; i < numCMs; i++ {
+		CMaddr[i] = address(i)
+	}
+	nodeAddr := map[int]string{}
+	for i := 1; i <= config.Nodes; i++ {
+		nodeAddr[i] = address(numCMs + i - 1)
+	}
+
+	pageRecords := func() []*PageRecord {
+		pageRecords := []*PageRecord{}
+		for p := 1; p <= config.Pages; p++ {
+			pageRecords = append(pageRecords, &PageRecord{PageNum: p, CopySet: []int{}, Owner: 1 + (p-1)%config.Nodes, Policy: config.Policy})
+		}
+		return pageRecords
+	}
+	cms := []*CentralManager{}
+	for i := 0; i < numCMs; i++ {
+		cms = append(cms, NewCentralManager(i, 0, nodeAddr, pageRecords(), CMaddr, 0, transport))
+	}
+	managers := []int{}
+	for i := 1; i <= config.Nodes; i++ {
+		managers = append(managers, i)
+	}
+	nodes := []*Node{}
+	for i := 1; i <= config.Nodes; i++ {
+		pages := []*Page{}
+		for p := i; p <= config.Pages; p += config.Nodes {
+			pages = append(pages, &Page{PageNum: p, Content: "", Access: WRITE})
+		}
+		node := NewNode(i, 0, CMaddr, nodeAddr, pages, transport)
+		if config.Manager == ManagerFixed {
+			// every node manages its share of a page table of its own
+			node.ManagePages(managers, pageRecords())
+		} else if config.Manager == ManagerDynamic {
+			node.ManageDynamically(managers, pageRecords())
+		}
+		nodes = append(nodes, node)
+	}
+
+	// the primary may already be stopped by the failure, so every CM is closed once
+	closeCM := make([]sync.Once, numCMs)
+	for i, cm := range cms {
+		if err := cm.Start(false); err != nil {
+			return result, err
+		}
+		defer closeCM[i].Do(func() { cm.Close() })
+	}
+	for _, node := range nodes {
+		if err := node.Start(nodeAddr[node.Id]); err != nil {
+			return result, err
+		}
+		defer node.Close()
+	}
+
+	var lock sync.Mutex
+	reads := []time.Duration{}
+	writes := []time.Duration{}
+	faults := []time.Duration{}
+	var wg sync.WaitGroup
+
+	transport.calls.Store(0)
+	transport.invalidations.Store(0)
+	transport.updates.Store(0)
+	start := time.Now()
+	if config.FailCMAfter > 0 {
+		failTimer := time.AfterFunc(config.FailCMAfter, func() { closeCM[0].Do(func() { cms[0].Close() }) })
+		defer failTimer.Stop()
+	}
+	for _, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(config.Seed + int64(node.Id)))
+			for i := 0; config.Duration > 0 || i < config.OpsPerNode; i++ {
+				if config.Duration > 0 && time.Since(start) >= config.Duration {
+					return
+				}
+				isWrite, latency, local, err := benchOp(node, rng, i, config)
+
+				lock.Lock()
+				if err != nil {
+					result.Errors++
+				} else {
+					result.Ops++
+					if isWrite {
+						writes = append(writes, latency)
+					} else {
+						reads = append(reads, latency)
+					}
+					if !local {
+						faults = append(faults, latency)
+					}
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+	result.Messages = transport.calls.Load()
+	result.Invalidations = transport.invalidations.Load()
+	result.Updates = transport.updates.Load()
+	if result.Ops > 0 {
+		result.Throughput = float64(result.Ops) / result.Elapsed.Seconds()
+		result.MessagesPerOp = float64(result.Messages) / float64(result.Ops)
+	}
+	result.Reads = latencyStats(reads)
+	result.Writes = latencyStats(writes)
+	result.Faults = latencyStats(faults)
+	return result, nil
+}
+
+// CheckFraction checks that a ratio given as name is between 0 and 1
+func CheckFraction(name string, value float64) error {
+	if value < 0 || value > 1 {
+		return fmt.Errorf("%s must be between 0 and 1, got %v", name, value)
+	}
+	return nil
+}
+
+// benchOp performs one random operation on node and reports whether it was a write, how long it
+// took and whether the node could serve it without a fault
+func benchOp(node *Node, rng *rand.Rand, i int, config BenchConfig) (bool, time.Duration, bool, error) {
+	pageNum := 1 + rng.Intn(config.Pages)
+	if config.Pattern == "hotspot" {
+		hot := int(float64(config.Pages)*config.HotPages + 0.5)
+		if hot < 1 {
+			hot = 1
+		}
+		if rng.Float64() < config.HotRatio || hot == config.Pages {
+			pageNum = 1 + rng.Intn(hot)
+		} else {
+			pageNum = 1 + hot + rng.Intn(config.Pages-hot)
+		}
+	}
+	isWrite := rng.Float64() < config.WriteRatio
+
+	// every node runs one operation at a time, so the counters only move for this operation
+	ctx, cancel := context.WithTimeout(context.Background(), replTimeout)
+	defer cancel()
+	var err error
+	var local bool
+	start := time.Now()
+	if isWrite {
+		before := node.metrics.localWrites.value.Load()
+		err = node.WritePage(ctx, pageNum, []byte(fmt.Sprintf("node %d write %d", node.Id, i)))
+		local = node.metrics.localWrites.value.Load() > before
+	} else {
+		before := node.metrics.localReads.value.Load()
+		_, err = node.ReadPage(ctx, pageNum)
+		local = node.metrics.localReads.value.Load() > before
+	}
+	return isWrite, time.Since(start), local, err
+}
+
+func latencyStats(latencies []time.Duration) LatencyStats {
+	stats := LatencyStats{Count: len(latencies)}
+	if len(latencies) == 0 {
+		return stats
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	percentile := func(q float64) time.Duration {
+		return latencies[int(q*float64(len(latencies)-1)+0.5)]
+	}
+	stats.Mean = total / time.Duration(len(latencies))
+	stats.P50 = percentile(0.5)
+	stats.P90 = percentile(0.9)
+	stats.P99 = percentile(0.99)
+	stats.Max = latencies[len(latencies)-1]
+	return stats
+}
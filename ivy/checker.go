@@ -0,0 +1,218 @@
+package ivy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// consistency models a history can be checked against
+const (
+	Sequential   = "sequential"   // the operations of a page can be put in one order that keeps the order of every node's own operations
+	Linearizable = "linearizable" // as Sequential, and an operation that returned before another was invoked comes first
+)
+
+// CheckResult is the outcome of checking the operations on one page
+type CheckResult struct {
+	PageNum        int
+	Operations     int
+	Ok             bool
+	Counterexample []Operation // if not Ok, operations of the page that cannot be ordered, none of which can be left out
+}
+
+func (result CheckResult) String() string {
+	if result.Ok {
+		return fmt.Sprintf("page %d: ok, %d operations", result.PageNum, result.Operations)
+	}
+	lines := []string{fmt.Sprintf("page %d: FAILED, %d operations, these %d cannot be ordered:", result.PageNum, result.Operations, len(result.Counterexample))}
+	for _, op := range result.Counterexample {
+		lines = append(lines, "  "+op.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// CheckHistory checks for every page whether its operations are consistent under model, in the
+// way of Porcupine: it searches for an order of the operations in which every read returns the
+// value of the write before it, or the page's content in initial if there is none. Pages missing
+// from initial start out empty, like allocated ones. Failed reads are left out, a failed write may
+// have taken effect at any point after it was invoked, or not at all. Operations of one node must
+// be in the order they returned
+func CheckHistory(operations []Operation, initial map[int]string, model string) ([]CheckResult, error) {
+	if model != Sequential && model != Linearizable {
+		return nil, fmt.Errorf("unknown consistency model %q, expected %s or %s", model, Sequential, Linearizable)
+	}
+
+	pages := map[int][]Operation{}
+	for _, op := range operations {
+		if op.Kind == "read" && !op.Ok {
+			continue
+		}
+		pages[op.PageNum] = append(pages[op.PageNum], op)
+	}
+	pageNums := []int{}
+	for pageNum := range pages {
+		pageNums = append(pageNums, pageNum)
+	}
+	sort.Ints(pageNums)
+
+	results := []CheckResult{}
+	for _, pageNum := range pageNums {
+		ops := pages[pageNum]
+		result := CheckResult{PageNum: pageNum, Operations: len(ops), Ok: orderable(ops, initial[pageNum], model)}
+		if !result.Ok {
+			// a write is only left out while no remaining read returns its value, otherwise any
+			// read would shrink down to a read of a value that was never written
+			written := writtenValues(ops)
+			result.Counterexample = shrink(ops, func(smaller []Operation) bool {
+				writtenInSmaller := writtenValues(smaller)
+				for _, op := range smaller {
+					if op.Kind == "read" && op.Value != initial[pageNum] && written[op.Value] && !writtenInSmaller[op.Value] {
+						return false
+					}
+				}
+				return !orderable(smaller, initial[pageNum], model)
+			})
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func writtenValues(ops []Operation) map[string]bool {
+	written := map[string]bool{}
+	for _, op := range ops {
+		if op.Kind == "write" {
+			written[op.Value] = true
+		}
+	}
+	return written
+}
+
+// bitset is a set of operation indexes
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (set bitset) has(i int) bool {
+	return set[i/64]&(1<<(i%64)) != 0
+}
+
+func (set bitset) add(i int) bitset {
+	added := append(bitset{}, set...)
+	added[i/64] |= 1 << (i % 64)
+	return added
+}
+
+// contains reports whether every index of other is in set
+func (set bitset) contains(other bitset) bool {
+	for i := range other {
+		if other[i]&^set[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (set bitset) key() string {
+	var b strings.Builder
+	for _, word := range set {
+		fmt.Fprintf(&b, "%x.", word)
+	}
+	return b.String()
+}
+
+// orderable reports whether the operations of one page that starts out as initial can be put in an
+// order that model allows
+func orderable(ops []Operation, initial string, model string) bool {
+	// before[j] holds the operations that have to come before operation j. A failed write has no
+	// return, so nothing has to come after it
+	before := make([]bitset, len(ops))
+	for j := range ops {
+		before[j] = newBitset(len(ops))
+		for i := range ops {
+			if i == j || !ops[i].Ok {
+				continue
+			}
+			sameNode := ops[i].Client == ops[j].Client && i < j
+			realTime := model == Linearizable && ops[i].Return < ops[j].Invoke
+			if sameNode || realTime {
+				before[j][i/64] |= 1 << (i % 64)
+			}
+		}
+	}
+
+	// states (operations done, current value) that are known to be dead ends
+	dead := map[string]bool{}
+	var search func(done bitset, value string) bool
+	search = func(done bitset, value string) bool {
+		// a read of the current value can go first, it does not change the value and only lets more
+		// operations be ready
+		for progress := true; progress; {
+			progress = false
+			for i, op := range ops {
+				if op.Kind == "read" && !done.has(i) && op.Value == value && done.contains(before[i]) {
+					done = done.add(i)
+					progress = true
+				}
+			}
+		}
+
+		finished := true
+		for i, op := range ops {
+			if op.Ok && !done.has(i) {
+				finished = false
+				break
+			}
+		}
+		if finished {
+			return true
+		}
+
+		key := done.key() + value
+		if dead[key] {
+			return false
+		}
+		for i, op := range ops {
+			if op.Kind == "write" && !done.has(i) && done.contains(before[i]) {
+				if search(done.add(i), op.Value) {
+					return true
+				}
+			}
+		}
+		dead[key] = true
+		return false
+	}
+	return search(newBitset(len(ops)), initial)
+}
+
+// shrink removes operations from ops for as long as fails still holds, first in large chunks and
+// then one by one, so that no single operation of the result can be left out. An operation may only
+// be left out once a later one is gone, so the last pass is repeated until it removes nothing
+func shrink(ops []Operation, fails func([]Operation) bool) []Operation {
+	for chunk := len(ops) / 2; chunk >= 1; chunk /= 2 {
+		ops = shrinkPass(ops, chunk, fails)
+	}
+	for {
+		smaller := shrinkPass(ops, 1, fails)
+		if len(smaller) == len(ops) {
+			return ops
+		}
+		ops = smaller
+	}
+}
+
+// shrinkPass goes once through ops and removes every chunk of chunk operations it can
+func shrinkPass(ops []Operation, chunk int, fails func([]Operation) bool) []Operation {
+	for start := 0; start < len(ops); {
+		end := min(start+chunk, len(ops))
+		smaller := append(append([]Operation{}, ops[:start]...), ops[end:]...)
+		if fails(smaller) {
+			ops = smaller
+		} else {
+			start = end
+		}
+	}
+	return ops
+}
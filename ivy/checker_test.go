@@ -0,0 +1,209 @@
+package ivy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// op is an operation that returned ok, with invoke and return times in nanoseconds
+func op(client int, kind string, value string, invoke int64, ret int64) Operation {
+	return Operation{Client: client, Kind: kind, PageNum: 1, Value: value, Invoke: invoke, Return: ret, Ok: true}
+}
+
+func failed(operation Operation) Operation {
+	operation.Ok = false
+	return operation
+}
+
+func TestOrderable(t *testing.T) {
+	tests := []struct {
+		name         string
+		ops          []Operation
+		sequential   bool
+		linearizable bool
+	}{
+		{
+			name:         "read of the write before it",
+			ops:          []Operation{op(1, "write", "x", 0, 1), op(2, "read", "x", 2, 3)},
+			sequential:   true,
+			linearizable: true,
+		},
+		{
+			name:         "read of a value never written",
+			ops:          []Operation{op(1, "write", "x", 0, 1), op(2, "read", "y", 2, 3)},
+			sequential:   false,
+			linearizable: false,
+		},
+		{
+			name:         "read of the initial value after the write returned",
+			ops:          []Operation{op(1, "write", "x", 0, 1), op(2, "read", "", 2, 3)},
+			sequential:   true,
+			linearizable: false,
+		},
+		{
+			name:         "node reads the new value and then the old one",
+			ops:          []Operation{op(1, "write", "x", 0, 1), op(2, "read", "x", 2, 3), op(2, "read", "", 4, 5)},
+			sequential:   false,
+			linearizable: false,
+		},
+		{
+			name: "nodes see two writes in different orders",
+			ops: []Operation{
+				op(1, "write", "a", 0, 1), op(2, "write", "b", 0, 1),
+				op(3, "read", "a", 2, 3), op(3, "read", "b", 4, 5),
+				op(4, "read", "b", 2, 3), op(4, "read", "a", 4, 5),
+			},
+			sequential:   false,
+			linearizable: false,
+		},
+		{
+			name:         "failed write that took effect",
+			ops:          []Operation{failed(op(1, "write", "x", 0, 1)), op(2, "read", "x", 2, 3)},
+			sequential:   true,
+			linearizable: true,
+		},
+		{
+			name:         "failed write that did not take effect",
+			ops:          []Operation{failed(op(1, "write", "x", 0, 1)), op(2, "read", "", 2, 3)},
+			sequential:   true,
+			linearizable: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := orderable(test.ops, "", Sequential); got != test.sequential {
+				t.Errorf("sequential: got %v, want %v", got, test.sequential)
+			}
+			if got := orderable(test.ops, "", Linearizable); got != test.linearizable {
+				t.Errorf("linearizable: got %v, want %v", got, test.linearizable)
+			}
+		})
+	}
+}
+
+func TestShrink(t *testing.T) {
+	values := func(ops []Operation) []string {
+		result := []string{}
+		for _, op := range ops {
+			result = append(result, op.Value)
+		}
+		return result
+	}
+	contains := func(ops []Operation, value string) bool {
+		for _, op := range ops {
+			if op.Value == value {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		name  string
+		fails func([]Operation) bool
+		want  []string
+	}{
+		{
+			name:  "two operations needed together",
+			fails: func(ops []Operation) bool { return contains(ops, "a") && contains(ops, "b") },
+			want:  []string{"a", "b"},
+		},
+		{
+			name:  "one operation needed",
+			fails: func(ops []Operation) bool { return contains(ops, "z") },
+			want:  []string{"z"},
+		},
+		{
+			name:  "fails without any operation",
+			fails: func(ops []Operation) bool { return true },
+			want:  []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ops := []Operation{}
+			for _, value := range []string{"x", "a", "y", "w", "b", "v", "z"} {
+				ops = append(ops, op(1, "write", value, 0, 1))
+			}
+			if got := values(shrink(ops, test.fails)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckHistory(t *testing.T) {
+	// page 2 is fine, on page 1 node 2 reads x and then the initial value, among operations that
+	// have nothing to do with it
+	w1 := op(1, "write", "x", 10, 11)
+	r2 := op(2, "read", "x", 12, 13)
+	stale := op(2, "read", "init", 14, 15)
+	operations := []Operation{
+		op(3, "write", "n", 0, 1), op(3, "read", "n", 2, 3),
+		w1, op(1, "read", "x", 11, 12), r2,
+		op(3, "write", "m", 13, 14), stale,
+		op(3, "read", "m", 16, 17),
+		{Client: 1, Kind: "write", PageNum: 2, Value: "p", Invoke: 0, Return: 1, Ok: true},
+		{Client: 2, Kind: "read", PageNum: 2, Value: "p", Invoke: 2, Return: 3, Ok: true},
+		{Client: 2, Kind: "read", PageNum: 2, Value: "lost", Invoke: 4, Return: 5, Ok: false},
+	}
+	initial := map[int]string{1: "init"}
+
+	results, err := CheckHistory(operations, initial, Sequential)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want one for each page", len(results))
+	}
+	if results[0].PageNum != 1 || results[0].Ok || results[0].Operations != 8 {
+		t.Errorf("page 1: got %v, want 8 operations that fail", results[0])
+	}
+	if want := []Operation{w1, r2, stale}; !reflect.DeepEqual(results[0].Counterexample, want) {
+		t.Errorf("page 1: got counterexample %v, want %v", results[0].Counterexample, want)
+	}
+	// the failed read is left out
+	if results[1].PageNum != 2 || !results[1].Ok || results[1].Operations != 2 {
+		t.Errorf("page 2: got %v, want 2 operations that pass", results[1])
+	}
+
+	if _, err := CheckHistory(operations, initial, "causal"); err == nil {
+		t.Error("unknown model accepted")
+	}
+}
+
+// a history file is appended to by a node that restarts, with the line it was writing when it
+// crashed cut off
+func TestOpenHistoryAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	history, err := OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history.record(op(1, "write", "x", 0, 1))
+	history.Close()
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"client":1,"kind":"re`)
+	file.Close()
+
+	history, err = OpenHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history.record(op(1, "read", "x", 2, 3))
+	history.Close()
+
+	operations, err := LoadHistory([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Operation{op(1, "write", "x", 0, 1), op(1, "read", "x", 2, 3)}; !reflect.DeepEqual(operations, want) {
+		t.Errorf("got %v, want %v", operations, want)
+	}
+}
@@ -0,0 +1,38 @@
+package ivy
+
+import "sync"
+
+// lamportClock is a logical clock. It is advanced before every message a process sends,
+// and moved past the timestamp of every message it receives
+type lamportClock struct {
+	lock sync.Mutex
+	time int
+}
+
+// tick advances the clock for a send and returns the timestamp to put on the message
+func (clock *lamportClock) tick() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.time++
+	return clock.time
+}
+
+// witness moves the clock past the timestamp of a received message and returns the new time
+func (clock *lamportClock) witness(timestamp int) int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	if timestamp > clock.time {
+		clock.time = timestamp
+	}
+	clock.time++
+	return clock.time
+}
+
+func (clock *lamportClock) now() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	return clock.time
+}
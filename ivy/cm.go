@@ -3,94 +3,335 @@ package ivy
 import (
 	"errors"
 	"fmt"
-	"net"
-	"net/rpc"
-	"strings"
+	"io"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	invalidateTimeout = 2 * time.Second // how long the CM waits for each node to acknowledge an invalidation
+	forwardTimeout    = 5 * time.Second // longer than sendPageTimeout, the owner sends the page before it answers
+	sendAttempts      = 5               // how many times the CM sends a forward, invalidation or update before giving up on a node
 )
 
 type CentralManager struct {
-	Id             int
-	clock          int
+	Id          int
+	clock       lamportClock
+	PageRecords []*PageRecord
+	records     map[int]*PageRecord  // PageRecords indexed by page number
+	freed       map[int]*PageRecord  // records of the freed pages, for answering a free sent again
+	frees       map[string]*freeWait // the frees FreePage RPCs are waiting for, by request id
+	lock        sync.RWMutex         // protects the page table and the membership, each PageRecord has its own lock
+
+	// node membership, see membership.go
 	nodeAddr       map[int]string
-	PageRecords    []*PageRecord
-	lock           sync.RWMutex
-	currentRequest *Request // to keep track of the current request
+	membersVersion int
+
+	// primary/backup replication, see replication.go
+	peers         map[int]string // addresses of every CM, including this one
+	isPrimary     bool
+	primaryId     int
+	epoch         int // bumped by every CM that becomes primary, the primary of the latest epoch wins
+	lastHeartbeat time.Time
+	acks          map[int]time.Time // when each backup last acknowledged this primary, see leaseExpired
+	leaseLost     bool              // set once the primary stepped down for its lease, see heartbeatLoop
+
+	// write-ahead log, see wal.go. recovered is set if the page table came from the log
+	wal       *WAL
+	recovered bool
+	walFailed bool // set once the log could not be written, see logFailed
+
+	// set if the CM is one of several page managers run by the nodes, see ManagePages. It then only
+	// allocates page numbers that are offset mod stride
+	stride int
+	offset int
+
+	metrics cmMetrics // see metrics.go
+	tracer  *Tracer   // records a span for every hop this CM handles if set, see OpenTrace
+
+	transport Transport
+	listener  io.Closer
+	quit      chan struct{} // closed to stop the heartbeat loop
 }
 
-func (cm *CentralManager) handleReadRequest(args *ReadRequestArgs) (int, error) {
-	// handles the read request by returning the owner of the page
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
+func (cm *CentralManager) findPageRecord(pageNum int) *PageRecord {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
 
-	if cm.currentRequest != nil {
-		// if there is a current request, return an error
-		return -1, errors.New("already handling another current request")
+	return cm.records[pageNum]
+}
+
+// enqueue adds a request to the queue of its page and starts serving it if the page is idle.
+// It returns the queued request, which is an earlier copy if the requester sent it before. If the
+// request is already finished it returns nil and the error the request failed with, if any
+func (cm *CentralManager) enqueue(request *Request) (*Request, error) {
+	pr := cm.findPageRecord(request.PageNum)
+	if pr == nil {
+		cm.lock.RLock()
+		pr = cm.freed[request.PageNum]
+		cm.lock.RUnlock()
+		if pr == nil {
+			return nil, errors.New("page not found")
+		}
 	}
-	cm.currentRequest = &Request{PageNum: args.PageNum, RequesterId: args.RequesterId, Clock: args.Clock, TypeOfReq: READ}
 
-	// find from page records
-	var ownerId = -1
-	for _, pr := range cm.PageRecords {
-		if pr.PageNum == args.PageNum {
-			ownerId = pr.Owner
-			break
+	pr.lock.Lock()
+	if served := pr.findServed(request.RequesterId, request.Id); served != nil {
+		// the reply to the request was lost and the requester sent it again
+		var update *UpdatePageArgs
+		if served.Seq > 0 {
+			// the writer is still waiting to hear that its update was applied
+			update = &UpdatePageArgs{PageNum: request.PageNum, Content: served.Content, Seq: served.Seq, OwnerId: pr.Owner, RequesterId: request.RequesterId, RequestId: request.Id}
+		}
+		err := served.err()
+		pr.lock.Unlock()
+		cm.log().Info("Request already served", "page", request.PageNum, "requester", request.RequesterId, "request", request.Id, "reason", served.Reason)
+		if update != nil {
+			spawn(cm.transport, func() { cm.sendUpdate(request.RequesterId, update) })
 		}
+		return nil, err
 	}
-	if ownerId == -1 {
-		return -1, errors.New("page not found")
+	if pr.freed {
+		pr.lock.Unlock()
+		return nil, errors.New("page not found")
 	}
+	if queued := pr.findRequest(request.Id); queued != nil {
+		// the requester is sending its request again after a failover. If the request was in flight
+		// at the previous primary nobody is serving it any more, so serve it from here
+		var toServe *Request
+		if pr.inherited && pr.inFlight == queued {
+			pr.inherited = false
+			toServe = pr.inFlight
+		}
+		pr.lock.Unlock()
+
+		if toServe != nil {
+			cm.log().Info("Serving request left over from the previous primary", "page", request.PageNum, "requester", request.RequesterId)
+			spawn(cm.transport, func() { cm.serve(pr, toServe) })
+		}
+		return queued, nil
+	}
+
+	request.queuedAt = now(cm.transport)
+	pr.queue.push(request)
+	cm.log().Info("Queued request", "page", request.PageNum, "requester", request.RequesterId, "request", request.Id, "clock", request.Clock, "waiting", len(pr.queue))
 
-	return ownerId, nil
+	var toServe *Request
+	if pr.inFlight == nil {
+		toServe = pr.next()
+	}
+	state, err := cm.snapshot(pr)
+	pr.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// the backups must know about the request before anything is forwarded
+	if err := cm.replicate(state); err != nil {
+		return nil, err
+	}
+	if toServe != nil {
+		spawn(cm.transport, func() { cm.serve(pr, toServe) })
+	}
+	return request, nil
 }
 
-func (cm *CentralManager) sendReadForward(nodeId int, args *ReadRequestArgs) error {
-	fmt.Println("Sending read forward to ", nodeId, "at", cm.nodeAddr[nodeId])
-	address := strings.TrimSpace(cm.nodeAddr[nodeId])
-	client, err := rpc.Dial("tcp", address)
+// complete finishes the in-flight request for a page if it is the one with requestId, failed with
+// reason if it is not nil, and moves on to the next one. update, if not nil, is applied to the page
+// record before the next request is served. A confirm sent again for a request that already
+// succeeded is accepted without applying update
+func (cm *CentralManager) complete(pageNum int, requesterId int, requestId string, reason error, update func(pr *PageRecord)) error {
+	pr := cm.findPageRecord(pageNum)
+	if pr == nil {
+		return errors.New("page not found")
+	}
+
+	pr.lock.Lock()
+	request := pr.inFlight
+	if request == nil || request.RequesterId != requesterId || request.Id != requestId {
+		served := pr.findServed(requesterId, requestId)
+		pr.lock.Unlock()
+		if served != nil && served.Reason == "" {
+			return nil
+		}
+		return errors.New("wrong confirm")
+	}
+	pr.remember(request, reason)
+	if update != nil {
+		update(pr)
+	}
+	if !request.queuedAt.IsZero() {
+		if request.TypeOfReq == READ {
+			cm.metrics.readSeconds.since(request.queuedAt, now(cm.transport))
+		} else if request.TypeOfReq == WRITE {
+			cm.metrics.writeSeconds.since(request.queuedAt, now(cm.transport))
+		}
+	}
+	next := pr.next()
+	state, err := cm.snapshot(pr)
+	pr.lock.Unlock()
 	if err != nil {
-		fmt.Println("Error connecting to node", err)
 		return err
 	}
-	defer client.Close()
 
-	readForwardArgs := &ReadForwardArgs{PageNum: args.PageNum, RequesterId: args.RequesterId, Clock: args.Clock}
+	if err := cm.replicate(state); err != nil {
+		return err
+	}
+	if next != nil {
+		spawn(cm.transport, func() { cm.serve(pr, next) })
+	}
+	return nil
+}
+
+// serve forwards a request to the owner of the page. If that fails the request is dropped
+// so that it does not hold up the rest of the queue
+func (cm *CentralManager) serve(pr *PageRecord, request *Request) {
+	if cm.tracer != nil && !request.queuedAt.IsZero() {
+		cm.tracer.record("Queued", request.Id, request.PageNum, request.RequesterId, request.queuedAt, now(cm.transport))
+	}
+	defer cm.span("Serve", request.Id, request.PageNum, request.RequesterId)()
+
+	var err error
+	if request.TypeOfReq == READ {
+		err = cm.serveRead(pr, request)
+	} else if request.TypeOfReq == FREE {
+		err = cm.serveFree(pr, request)
+	} else if request.TypeOfReq == ALLOCATE {
+		err = cm.serveAllocate(pr, request)
+	} else {
+		err = cm.serveWrite(pr, request)
+	}
+	if err != nil {
+		if cm.checkPrimary() != nil {
+			// this CM handed over while the request was being served, the new primary owns the request now
+			cm.log().Info("Error serving request after stepping down", "page", request.PageNum, "requester", request.RequesterId, "err", err)
+			return
+		}
+		pr.lock.Lock()
+		inFlight := pr.inFlight == request
+		pr.lock.Unlock()
+		if !inFlight {
+			// the requester confirmed while the last copy of a forward was failing
+			return
+		}
+		cm.log().Warn("Dropping request", "page", request.PageNum, "requester", request.RequesterId, "request", request.Id, "err", err)
+		cm.metrics.droppedRequests.inc()
+		if cm.complete(request.PageNum, request.RequesterId, request.Id, err, nil) == nil {
+			cm.sendRequestFailed(request, err)
+		}
+	}
+}
+
+// sendRequestFailed tells the requester that its request was dropped so it does not wait for the page.
+// A free is waited for by FreePage RPCs on this CM, which get the error instead
+func (cm *CentralManager) sendRequestFailed(request *Request, reason error) {
+	if request.TypeOfReq == FREE && cm.finishFree(request.Id, reason) {
+		return
+	}
+
+	req := &RequestFailedArgs{PageNum: request.PageNum, TypeOfReq: request.TypeOfReq, Reason: reason.Error(), RequestId: request.Id, Clock: cm.clock.tick()}
+	res := &RequestFailedResponse{}
+
+	// if this is lost the requester finds out when it sends the request again
+	err := cm.transport.Call(cm.nodeAddress(request.RequesterId), "Node.RequestFailed", req, res, invalidateTimeout)
+	if err != nil {
+		cm.log().Warn("Error calling RequestFailed", "page", request.PageNum, "requester", request.RequesterId, "err", err)
+		return
+	}
+	cm.clock.witness(res.Clock)
+}
+
+func (cm *CentralManager) serveRead(pr *PageRecord, request *Request) error {
+	pr.lock.Lock()
+	ownerId := pr.Owner
+	applied := pr.applied
+	pr.lock.Unlock()
+
+	// send forward message to the owner of the page
+	return cm.forward(pr, request, func() error { return cm.sendReadForward(ownerId, request, applied) })
+}
+
+// forward calls send until it succeeds or sendAttempts calls have failed, and stops early once the
+// request is no longer in flight. A forward that reached the owner but whose reply was lost is sent
+// again, the owner and the requester both recognize the copy by its request id
+func (cm *CentralManager) forward(pr *PageRecord, request *Request, send func() error) error {
+	var err error
+	for attempt := 0; attempt < sendAttempts; attempt++ {
+		pr.lock.Lock()
+		inFlight := pr.inFlight == request
+		pr.lock.Unlock()
+		if !inFlight {
+			return nil
+		}
+		err = send()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (cm *CentralManager) sendReadForward(nodeId int, request *Request, applied int) error {
+	defer cm.span("ReadForward", request.Id, request.PageNum, request.RequesterId)()
+	readForwardArgs := &ReadForwardArgs{PageNum: request.PageNum, RequesterId: request.RequesterId, RequestId: request.Id, Applied: applied, Clock: cm.clock.tick()}
 	readForwardResponse := &ReadForwardResponse{}
+	cm.metrics.readForwards.inc()
 
-	err = client.Call("Node.ReadForward", readForwardArgs, readForwardResponse)
+	cm.log().Info("Sending read forward", "page", request.PageNum, "owner", nodeId, "address", cm.nodeAddress(nodeId), "requester", request.RequesterId, "request", request.Id, "clock", readForwardArgs.Clock)
+	err := cm.transport.Call(cm.nodeAddress(nodeId), "Node.ReadForward", readForwardArgs, readForwardResponse, forwardTimeout)
 	if err != nil {
-		fmt.Println("Error calling Readforward to", nodeId, err)
+		cm.log().Error("Error calling ReadForward", "page", request.PageNum, "owner", nodeId, "err", err)
 		return err
 	}
+	cm.clock.witness(readForwardResponse.Clock)
 
 	return nil
 }
 
-// ReadRequest is an RPC method that is called by a node to read a page
+// ReadRequest is an RPC method that is called by a node to read a page.
+// The request is queued behind any other request for the same page
 func (cm *CentralManager) ReadRequest(args *ReadRequestArgs, res *ReadRequestResponse) error {
-	ownerId, err := cm.handleReadRequest(args)
+	if err := cm.checkPrimary(); err != nil {
+		return err
+	}
+	clock := cm.clock.witness(args.Clock)
+	cm.log().Info("Read request", "page", args.PageNum, "requester", args.RequesterId, "request", args.RequestId, "clock", clock)
+	cm.metrics.readRequests.inc()
+	defer cm.span("ReadRequest", args.RequestId, args.PageNum, args.RequesterId)()
+	defer func() { res.Clock = cm.clock.tick() }()
+	request := &Request{Id: args.RequestId, PageNum: args.PageNum, RequesterId: args.RequesterId, Clock: args.Clock, TypeOfReq: READ}
+	_, err := cm.enqueue(request)
 	if err != nil {
-		fmt.Println("Error handling read request: ", err)
+		cm.log().Error("Error handling read request", "page", args.PageNum, "requester", args.RequesterId, "err", err)
 		return err
 	}
-	// send forward message to the owner of the page
-	fmt.Println("Sending read forward to ", ownerId)
-	cm.sendReadForward(ownerId, args)
-
 	return nil
 }
 
 // ReadConfirm rpc called by the node
 func (cm *CentralManager) ReadConfirm(ReadConfirmArgs *ReadConfirmArgs, response *ReadConfirmResponse) error {
-	// check if the confirm matches the current request
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
+	if err := cm.checkPrimary(); err != nil {
+		return err
+	}
+	clock := cm.clock.witness(ReadConfirmArgs.Clock)
+	defer func() { response.Clock = cm.clock.tick() }()
+	defer cm.span("ReadConfirm", ReadConfirmArgs.RequestId, ReadConfirmArgs.PageNum, ReadConfirmArgs.RequesterId)()
 
-	if cm.currentRequest.PageNum != ReadConfirmArgs.PageNum || cm.currentRequest.RequesterId != ReadConfirmArgs.RequesterId {
-		return errors.New("wrong confirm")
+	// check if the confirm matches the current request
+	err := cm.complete(ReadConfirmArgs.PageNum, ReadConfirmArgs.RequesterId, ReadConfirmArgs.RequestId, nil, func(pr *PageRecord) {
+		// the reader now holds a copy that has to be invalidated on the next write
+		if pr.Owner != ReadConfirmArgs.RequesterId && !containsNode(pr.CopySet, ReadConfirmArgs.RequesterId) {
+			pr.AddCopy(ReadConfirmArgs.RequesterId)
+		}
+		cm.log().Info("Page record updated", "page", pr.PageNum, "owner", pr.Owner, "copyset", pr.CopySet)
+	})
+	if err != nil {
+		return err
 	}
-	fmt.Println("Request completed for", ReadConfirmArgs)
-	cm.currentRequest = nil
+	cm.log().Info("Read completed", "page", ReadConfirmArgs.PageNum, "requester", ReadConfirmArgs.RequesterId, "request", ReadConfirmArgs.RequestId, "clock", clock)
 
 	response.Confirm = true
 
@@ -99,133 +340,348 @@ func (cm *CentralManager) ReadConfirm(ReadConfirmArgs *ReadConfirmArgs, response
 
 // WriteConfirm rpc called by the node
 func (cm *CentralManager) WriteConfirm(WriteConfirmArgs *WriteConfirmArgs, response *WriteConfirmResponse) error {
-	// check if the confirm matches the current request
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
+	if err := cm.checkPrimary(); err != nil {
+		return err
+	}
+	clock := cm.clock.witness(WriteConfirmArgs.Clock)
+	defer func() { response.Clock = cm.clock.tick() }()
+	defer cm.span("WriteConfirm", WriteConfirmArgs.RequestId, WriteConfirmArgs.PageNum, WriteConfirmArgs.RequesterId)()
 
-	if cm.currentRequest.PageNum != WriteConfirmArgs.PageNum || cm.currentRequest.RequesterId != WriteConfirmArgs.RequesterId {
-		return errors.New("wrong confirm")
+	// check if the confirm matches the current request
+	err := cm.complete(WriteConfirmArgs.PageNum, WriteConfirmArgs.RequesterId, WriteConfirmArgs.RequestId, nil, func(pr *PageRecord) {
+		// the writer owns the only copy of the page now
+		pr.Owner = WriteConfirmArgs.RequesterId
+		pr.CopySet = []int{}
+		cm.log().Info("Page record updated", "page", pr.PageNum, "owner", pr.Owner, "copyset", pr.CopySet)
+	})
+	if err != nil {
+		return err
 	}
-	fmt.Println("Request completed for", WriteConfirmArgs)
-	cm.currentRequest = nil
+	cm.log().Info("Write completed", "page", WriteConfirmArgs.PageNum, "requester", WriteConfirmArgs.RequesterId, "request", WriteConfirmArgs.RequestId, "clock", clock)
 
 	response.Confirm = true
 
 	return nil
 }
 
-func (cm *CentralManager) sendWriteForward(ownerId int, args *WriteRequestArgs) error {
-	fmt.Println("Sending write forward to ", ownerId, "at", cm.nodeAddr[ownerId])
-	address := strings.TrimSpace(cm.nodeAddr[ownerId])
-	client, err := rpc.Dial("tcp", address)
-	if err != nil {
-		fmt.Println("Error connecting to node", err)
-		return err
+// PageInfo rpc returns the owner and copy set the CM has on record for a page
+func (cm *CentralManager) PageInfo(args *PageInfoArgs, res *PageInfoResponse) error {
+	pr := cm.findPageRecord(args.PageNum)
+	if pr == nil {
+		return errors.New("page not found")
 	}
-	defer client.Close()
 
-	writeForwardArgs := &WriteForwardArgs{PageNum: args.PageNum, Content: args.Content, RequesterId: args.RequesterId, Clock: args.Clock}
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+
+	res.PageNum = pr.PageNum
+	res.Owner = pr.Owner
+	res.CopySet = append([]int{}, pr.CopySet...)
+	res.Policy = pr.Policy
+	res.Waiting = len(pr.queue)
+	if pr.inFlight != nil {
+		res.Waiting++
+	}
+	return nil
+}
+
+func (cm *CentralManager) sendWriteForward(ownerId int, request *Request, applied int) error {
+	defer cm.span("WriteForward", request.Id, request.PageNum, request.RequesterId)()
+	writeForwardArgs := &WriteForwardArgs{PageNum: request.PageNum, Content: request.Content, RequesterId: request.RequesterId, RequestId: request.Id, Applied: applied, Clock: cm.clock.tick()}
 	writeForwardResponse := &WriteForwardResponse{}
+	cm.metrics.writeForwards.inc()
 
-	err = client.Call("Node.WriteForward", writeForwardArgs, writeForwardResponse)
+	cm.log().Info("Sending write forward", "page", request.PageNum, "owner", ownerId, "address", cm.nodeAddress(ownerId), "requester", request.RequesterId, "request", request.Id, "clock", writeForwardArgs.Clock)
+	err := cm.transport.Call(cm.nodeAddress(ownerId), "Node.WriteForward", writeForwardArgs, writeForwardResponse, forwardTimeout)
 	if err != nil {
-		fmt.Println("Error calling WriteForward to", ownerId, err)
+		cm.log().Error("Error calling WriteForward", "page", request.PageNum, "owner", ownerId, "err", err)
 		return err
 	}
+	cm.clock.witness(writeForwardResponse.Clock)
 
 	return nil
 }
 
-// WriteRequest rpc called by the node to write a page
-func (cm *CentralManager) WriteRequest(args *WriteRequestArgs, res *WriteRequestResponse) error {
-	cm.lock.Lock()
-	defer cm.lock.Unlock()
-
-	// find the page record
-	var pr *PageRecord
-	for _, pageRecord := range cm.PageRecords {
-		if pageRecord.PageNum == args.PageNum {
-			pr = pageRecord
-			break
+func (cm *CentralManager) serveWrite(pr *PageRecord, request *Request) error {
+	pr.lock.Lock()
+	if pr.Policy == PolicyUpdate {
+		pr.lock.Unlock()
+		return cm.serveUpdate(pr, request)
+	}
+	ownerId := pr.Owner
+	applied := pr.applied
+	copySet := []int{}
+	for _, nodeId := range pr.CopySet {
+		// the owner hands its copy over in WriteForward
+		if nodeId != ownerId {
+			copySet = append(copySet, nodeId)
 		}
 	}
+	pr.lock.Unlock()
 
-	if pr == nil {
-		return errors.New("page not found")
+	// invalidate pages in the copy set, the write is only forwarded once every copy is gone
+	cm.metrics.invalidationsPerOp.observe(float64(len(copySet)))
+	acked, err := cm.invalidateCopies(request, copySet)
+	if dropErr := cm.dropCopies(pr, acked); dropErr != nil {
+		return dropErr
+	}
+	if err != nil {
+		return err
 	}
 
-	// invalidate pages in the copy set
+	return cm.forward(pr, request, func() error { return cm.sendWriteForward(ownerId, request, applied) })
+}
+
+// dropCopies removes the nodes that acknowledged an invalidation from the copy set
+func (cm *CentralManager) dropCopies(pr *PageRecord, acked []int) error {
+	if len(acked) == 0 {
+		return nil
+	}
+
+	pr.lock.Lock()
+	newCopySet := []int{}
 	for _, nodeId := range pr.CopySet {
-		address := strings.TrimSpace(cm.nodeAddr[nodeId])
-		client, err := rpc.Dial("tcp", address)
-		if err != nil {
-			fmt.Println("Error connecting to node", err)
+		if !containsNode(acked, nodeId) {
+			newCopySet = append(newCopySet, nodeId)
 		}
-		defer client.Close()
+	}
+	pr.CopySet = newCopySet
+	cm.log().Info("Removed nodes from copyset", "page", pr.PageNum, "removed", acked, "copyset", pr.CopySet)
+	state, err := cm.snapshot(pr)
+	pr.lock.Unlock()
+	if err != nil {
+		return err
+	}
 
-		req := &InvalidateArgs{PageNum: args.PageNum}
-		res := &InvalidateResponse{}
+	return cm.replicate(state)
+}
 
-		err = client.Call("Node.Invalidate", req, res)
-		if err != nil {
-			logInfo(fmt.Sprintf("Error calling Invalidate: %s", err))
-			return err
+// invalidateCopies sends an invalidation of the page of request to every node in copySet at the same time
+// and waits for all of them. It returns the nodes that acknowledged, and an error listing the ones that did not
+func (cm *CentralManager) invalidateCopies(request *Request, copySet []int) ([]int, error) {
+	pageNum := request.PageNum
+	errs := make([]error, len(copySet))
+	var wg sync.WaitGroup
+	for i, nodeId := range copySet {
+		wg.Add(1)
+		spawn(cm.transport, func() {
+			defer wg.Done()
+			errs[i] = cm.sendInvalidate(nodeId, request)
+		})
+	}
+	wg.Wait()
+
+	acked := []int{}
+	failed := []int{}
+	for i, nodeId := range copySet {
+		if errs[i] != nil {
+			cm.log().Warn("Invalidate failed", "page", pageNum, "to", nodeId, "err", errs[i])
+			cm.metrics.invalidationsFailed.inc()
+			failed = append(failed, nodeId)
+		} else {
+			acked = append(acked, nodeId)
 		}
+	}
 
-		if !res.Ack {
-			logInfo(fmt.Sprintf("Invalidate failed for node %d", nodeId))
-		}
+	if len(failed) > 0 {
+		return acked, fmt.Errorf("invalidation of page %d not acknowledged by nodes %v", pageNum, failed)
+	}
+	return acked, nil
+}
 
-		// remove node from copyset
-		newCopySet := []int{}
-		for _, node := range pr.CopySet {
-			if node != nodeId {
-				newCopySet = append(newCopySet, node)
-			}
+// sendInvalidate asks one node to drop its copy of the page of request. Each try gives up after
+// invalidateTimeout, and the node is tried sendAttempts times, dropping a copy twice does no harm
+func (cm *CentralManager) sendInvalidate(nodeId int, request *Request) error {
+	defer cm.span("Invalidate", request.Id, request.PageNum, request.RequesterId)()
+	pageNum := request.PageNum
+	res := &InvalidateResponse{}
+	var err error
+	for attempt := 0; attempt < sendAttempts; attempt++ {
+		req := &InvalidateArgs{PageNum: pageNum, RequesterId: request.RequesterId, RequestId: request.Id, Clock: cm.clock.tick()}
+		cm.metrics.invalidations.inc()
+		cm.log().Info("Sending invalidate", "page", pageNum, "to", nodeId, "request", request.Id, "clock", req.Clock)
+		err = cm.transport.Call(cm.nodeAddress(nodeId), "Node.Invalidate", req, res, invalidateTimeout)
+		if err == nil {
+			break
 		}
-		pr.CopySet = newCopySet
-		logInfo(fmt.Sprintf("Removed node %d from copyset, current copyset %v", nodeId, pr.CopySet))
+	}
+	if err != nil {
+		return err
+	}
+	cm.clock.witness(res.Clock)
 
-		return nil
+	if !res.Ack {
+		return errors.New("not acknowledged")
 	}
+	return nil
+}
 
-	logInfo(fmt.Sprintf("Sending write forward to node %d", pr.Owner))
-	cm.sendWriteForward(pr.Owner, args)
+func containsNode(nodes []int, nodeId int) bool {
+	for _, node := range nodes {
+		if node == nodeId {
+			return true
+		}
+	}
+	return false
+}
 
+// WriteRequest rpc called by the node to write a page.
+// The request is queued behind any other request for the same page
+func (cm *CentralManager) WriteRequest(args *WriteRequestArgs, res *WriteRequestResponse) error {
+	if err := cm.checkPrimary(); err != nil {
+		return err
+	}
+	clock := cm.clock.witness(args.Clock)
+	cm.log().Info("Write request", "page", args.PageNum, "requester", args.RequesterId, "request", args.RequestId, "clock", clock)
+	cm.metrics.writeRequests.inc()
+	defer cm.span("WriteRequest", args.RequestId, args.PageNum, args.RequesterId)()
+	defer func() { res.Clock = cm.clock.tick() }()
+	request := &Request{Id: args.RequestId, PageNum: args.PageNum, RequesterId: args.RequesterId, Clock: args.Clock, TypeOfReq: WRITE, Content: args.Content}
+	_, err := cm.enqueue(request)
+	if err != nil {
+		cm.log().Error("Error handling write request", "page", args.PageNum, "requester", args.RequesterId, "err", err)
+		return err
+	}
 	return nil
 }
 
-func RegisterCM(CMID int, clock int, nodeAddr map[int]string, pageRecords []*PageRecord, CMaddr string) {
-
+// NewCentralManager creates the CM with id CMID. The CM with id primaryId starts as the primary, every
+// other CM in CMaddr is a backup that takes over if the primary fails
+func NewCentralManager(CMID int, clock int, nodeAddr map[int]string, pageRecords []*PageRecord, CMaddr map[int]string, primaryId int, transport Transport) *CentralManager {
 	cm := &CentralManager{
-		Id:             CMID,
-		clock:          clock,
-		nodeAddr:       nodeAddr,
-		PageRecords:    pageRecords,
-		lock:           sync.RWMutex{},
-		currentRequest: nil,
+		Id:            CMID,
+		clock:         lamportClock{time: clock},
+		nodeAddr:      map[int]string{},
+		PageRecords:   pageRecords,
+		records:       map[int]*PageRecord{},
+		freed:         map[int]*PageRecord{},
+		frees:         map[string]*freeWait{},
+		lock:          sync.RWMutex{},
+		peers:         CMaddr,
+		isPrimary:     CMID == primaryId,
+		primaryId:     primaryId,
+		lastHeartbeat: now(transport),
+		acks:          map[int]time.Time{},
+		transport:     transport,
+		quit:          make(chan struct{}),
+		metrics:       newCMMetrics(),
+	}
+	for _, pr := range pageRecords {
+		cm.records[pr.PageNum] = pr
+	}
+	for id, address := range nodeAddr {
+		cm.nodeAddr[id] = address
+	}
+	return cm
+}
+
+// Start serves the CM on CMaddr[CMID]. The CM starts as a backup and asks the other CMs first. If
+// another CM is already acting as primary, the CM rejoins as a backup with that CM's state, and if
+// reclaimPrimary is set it then asks for the primary role back. Otherwise the CM given as primary to
+// NewCentralManager becomes the primary
+func (cm *CentralManager) Start(reclaimPrimary bool) error {
+	// a restarted primary must not serve next to the CM that took over from it
+	cm.lock.Lock()
+	configuredPrimary := cm.isPrimary
+	cm.isPrimary = false
+	cm.lock.Unlock()
+
+	if !cm.rejoin(reclaimPrimary) && configuredPrimary {
+		cm.lock.Lock()
+		cm.isPrimary = true
+		cm.primaryId = cm.Id
+		cm.epoch++
+		records := append([]*PageRecord{}, cm.PageRecords...)
+		cm.lock.Unlock()
+		if cm.recovered {
+			// nobody else took over while this CM was down, the requests it was serving are still its own
+			cm.inherit(records)
+		}
 	}
 
-	err := rpc.Register(cm)
+	listener, err := cm.transport.Serve(cm.peers[cm.Id], map[string]any{"CentralManager": cm})
 	if err != nil {
-		fmt.Println("Error registering CentralManager", err)
-		return
+		return err
+	}
+	cm.listener = listener
+	spawn(cm.transport, cm.heartbeatLoop)
+	return nil
+}
+
+// Close stops serving the CM and stops its heartbeats, to the other CMs it looks like it failed
+func (cm *CentralManager) Close() error {
+	close(cm.quit)
+	var err error
+	if cm.listener != nil {
+		// a page manager run by a node has no listener of its own
+		err = cm.listener.Close()
+	}
+	if cm.wal != nil {
+		cm.wal.Close()
 	}
+	return err
+}
+
+// CMOptions configures a CM run by RegisterCM, see NewCentralManager
+type CMOptions struct {
+	Id             int
+	Clock          int
+	NodeAddr       map[int]string
+	PageRecords    []*PageRecord
+	CMAddr         map[int]string
+	PrimaryId      int
+	ReclaimPrimary bool   // ask for the primary role back from a CM that took over, see Start
+	WALDir         string // if not empty the CM logs its changes there, see OpenWAL
+	MetricsAddr    string // if not empty the CM's metrics are served on http://MetricsAddr/metrics
+	TraceFile      string // if not empty the CM records the hops of the requests it handles there, see Tracer
+}
 
-	listener, err := net.Listen("tcp", CMaddr)
+// RegisterCM starts a CM over TCP and serves it until the process gets SIGINT or SIGTERM, see
+// NewCentralManager and Start. A CM with a write-ahead log rebuilds its page table and membership
+// from the log on a restart, instead of options.PageRecords and options.NodeAddr
+func RegisterCM(options CMOptions) {
+	cm := NewCentralManager(options.Id, options.Clock, options.NodeAddr, options.PageRecords, options.CMAddr, options.PrimaryId, NewTCPTransport())
+	if options.WALDir != "" {
+		err := cm.OpenWAL(options.WALDir)
+		if err != nil {
+			cm.log().Error("Error opening write-ahead log", "dir", options.WALDir, "err", err)
+			return
+		}
+	}
+	if options.TraceFile != "" {
+		err := cm.OpenTrace(options.TraceFile)
+		if err != nil {
+			cm.log().Error("Error opening trace file", "file", options.TraceFile, "err", err)
+			return
+		}
+		defer cm.tracer.Close()
+	}
+
+	err := cm.Start(options.ReclaimPrimary)
 	if err != nil {
-		fmt.Println("Error starting CM")
+		cm.log().Error("Error starting CM", "address", options.CMAddr[options.Id], "err", err)
 		return
 	}
-	defer listener.Close()
+	defer cm.Close()
 
-	fmt.Println("Central Manager is running on port 1234...")
-	for {
-		conn, err := listener.Accept()
+	if options.MetricsAddr != "" {
+		server, err := ServeMetrics(options.MetricsAddr, cm.WriteMetrics)
 		if err != nil {
-			fmt.Println("Error accepting")
-			continue
+			cm.log().Error("Error serving metrics", "address", options.MetricsAddr, "err", err)
+			return
 		}
-		go rpc.ServeConn(conn)
+		defer server.Close()
 	}
+
+	role := "backup"
+	if cm.checkPrimary() == nil {
+		role = "primary"
+	}
+	cm.log().Info("Central Manager running", "role", role, "address", options.CMAddr[options.Id])
+
+	// returning runs the closes above, which flush the trace and close the write-ahead log
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	cm.log().Info("Central Manager stopping", "signal", sig.String())
 }
@@ -1,11 +1,183 @@
 package ivy
 
+import (
+	"errors"
+	"sync"
+)
+
+// how many finished requests of each requester the CM remembers for a page
+const servedPerRequester = 4
+
+// ServedRequest is a request the CM has finished, remembered so that a copy of it that arrives late
+// is answered instead of served a second time
+type ServedRequest struct {
+	Id     string
+	Reason string // why the request failed, empty if it succeeded
+
+	// for a write under the update policy, the update it was applied as
+	Seq     int
+	Content string
+}
+
+func (served *ServedRequest) err() error {
+	if served.Reason == "" {
+		return nil
+	}
+	return errors.New(served.Reason)
+}
+
 type PageRecord struct {
 	PageNum int
 	CopySet []int
 	Owner   int
+	Policy  string // PolicyUpdate pushes writes to the copies instead of invalidating them, see update.go
+
+	// requests for one page are served one at a time, requests for different pages in parallel
+	lock      sync.Mutex
+	inFlight  *Request                // request currently being served
+	queue     requestQueue            // requests waiting behind inFlight
+	inherited bool                    // inFlight was started by a previous primary and is not being served here
+	freed     bool                    // the page has been freed and taken out of the page table
+	version   int                     // bumped on every change, lets backups drop stale replication messages
+	updates   int                     // number of the last write pushed to the copies under the update policy
+	applied   int                     // number of the last of those writes that went through, see serveUpdate
+	served    map[int][]ServedRequest // the last requests finished for each requester, oldest first
+}
+
+// PageRecordState is the copy of a PageRecord that the primary CM sends to its backups
+type PageRecordState struct {
+	PageNum  int
+	CopySet  []int
+	Owner    int
+	Policy   string
+	Updates  int
+	Applied  int
+	Served   map[int][]ServedRequest
+	InFlight *Request
+	Queue    []*Request
+	Freed    bool
+	Version  int
 }
 
 func (pageRecord *PageRecord) AddCopy(nodeId int) {
 	pageRecord.CopySet = append(pageRecord.CopySet, nodeId)
 }
+
+// next makes the next queued request the in-flight one and returns it, or nil if the queue is empty.
+// pageRecord.lock must be held by the caller
+func (pageRecord *PageRecord) next() *Request {
+	pageRecord.inFlight = pageRecord.queue.pop()
+	pageRecord.inherited = false
+	return pageRecord.inFlight
+}
+
+// findRequest returns the request with id that is in flight or queued for the page, or nil.
+// pageRecord.lock must be held by the caller
+func (pageRecord *PageRecord) findRequest(id string) *Request {
+	if pageRecord.inFlight != nil && pageRecord.inFlight.Id == id {
+		return pageRecord.inFlight
+	}
+	for _, request := range pageRecord.queue {
+		if request.Id == id {
+			return request
+		}
+	}
+	return nil
+}
+
+// hasRequestFrom reports whether requesterId has a request in flight or queued for the page.
+// pageRecord.lock must be held by the caller
+func (pageRecord *PageRecord) hasRequestFrom(requesterId int) bool {
+	if pageRecord.inFlight != nil && pageRecord.inFlight.RequesterId == requesterId {
+		return true
+	}
+	for _, request := range pageRecord.queue {
+		if request.RequesterId == requesterId {
+			return true
+		}
+	}
+	return false
+}
+
+// remember records that a request is finished, failed with reason if it is not nil. Only the last
+// servedPerRequester requests of each requester are kept, a node has one request out at a time so a
+// copy of an older one cannot still be on its way. pageRecord.lock must be held by the caller
+func (pageRecord *PageRecord) remember(request *Request, reason error) {
+	served := ServedRequest{Id: request.Id}
+	if reason != nil {
+		served.Reason = reason.Error()
+	}
+	old := pageRecord.served[request.RequesterId]
+	if len(old) >= servedPerRequester {
+		old = old[len(old)-servedPerRequester+1:]
+	}
+	if pageRecord.served == nil {
+		pageRecord.served = map[int][]ServedRequest{}
+	}
+	// a new slice, the old one may be shared with a replicated state
+	pageRecord.served[request.RequesterId] = append(append([]ServedRequest{}, old...), served)
+}
+
+// findServed returns the finished request with id from requesterId, or nil.
+// pageRecord.lock must be held by the caller
+func (pageRecord *PageRecord) findServed(requesterId int, id string) *ServedRequest {
+	for i, served := range pageRecord.served[requesterId] {
+		if served.Id == id {
+			return &pageRecord.served[requesterId][i]
+		}
+	}
+	return nil
+}
+
+// snapshot records a change to the page and returns its state for replication.
+// pageRecord.lock must be held by the caller
+func (pageRecord *PageRecord) snapshot() PageRecordState {
+	pageRecord.version++
+	return pageRecord.state()
+}
+
+// state returns the current state of the page. pageRecord.lock must be held by the caller
+func (pageRecord *PageRecord) state() PageRecordState {
+	return PageRecordState{
+		PageNum:  pageRecord.PageNum,
+		CopySet:  append([]int{}, pageRecord.CopySet...),
+		Owner:    pageRecord.Owner,
+		Policy:   pageRecord.Policy,
+		Updates:  pageRecord.updates,
+		Applied:  pageRecord.applied,
+		Served:   pageRecord.servedState(),
+		InFlight: pageRecord.inFlight,
+		Queue:    append([]*Request{}, pageRecord.queue...),
+		Freed:    pageRecord.freed,
+		Version:  pageRecord.version,
+	}
+}
+
+// servedState copies the finished requests for a state, the slices are never changed in place.
+// pageRecord.lock must be held by the caller
+func (pageRecord *PageRecord) servedState() map[int][]ServedRequest {
+	served := map[int][]ServedRequest{}
+	for requesterId, requests := range pageRecord.served {
+		served[requesterId] = requests
+	}
+	return served
+}
+
+// restore overwrites the page with a replicated state unless it is older than what we have,
+// and reports whether it did. pageRecord.lock must be held by the caller
+func (pageRecord *PageRecord) restore(state PageRecordState) bool {
+	if state.Version <= pageRecord.version {
+		return false
+	}
+	pageRecord.CopySet = state.CopySet
+	pageRecord.Owner = state.Owner
+	pageRecord.Policy = state.Policy
+	pageRecord.updates = state.Updates
+	pageRecord.applied = state.Applied
+	pageRecord.served = state.Served
+	pageRecord.inFlight = state.InFlight
+	pageRecord.queue = state.Queue
+	pageRecord.freed = state.Freed
+	pageRecord.version = state.Version
+	return true
+}
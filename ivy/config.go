@@ -0,0 +1,245 @@
+package ivy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// ClusterConfig describes the CMs and nodes of a cluster and where every page starts out.
+// It is read from a JSON file such as cluster.json:
+//
+//	{
+//	  "primary": 0,
+//	  "cms": [{"id": 0, "address": "localhost:1234", "wal": "data/cm0"}, {"id": 1, "address": "localhost:1237"}],
+//	  "nodes": [{"id": 1, "address": "localhost:1235", "store": "data/node1"}, {"id": 2, "address": "localhost:1236"}],
+//	  "pages": [{"page": 1, "owner": 1, "content": "Hello"}]
+//	}
+//
+// With "manager": "fixed" or "dynamic" the nodes manage the pages themselves and no CMs are needed
+type ClusterConfig struct {
+	Manager string       `json:"manager,omitempty"` // "central" (the default), "fixed" or "dynamic", see ManagerFixed
+	Primary int          `json:"primary"`           // id of the CM that starts as primary
+	CMs     []CMConfig   `json:"cms"`
+	Nodes   []NodeConfig `json:"nodes"`
+	Pages   []PageConfig `json:"pages"`
+}
+
+type CMConfig struct {
+	Id      int    `json:"id"`
+	Address string `json:"address"`
+	WAL     string `json:"wal,omitempty"` // directory of the CM's write-ahead log, none if empty
+}
+
+type NodeConfig struct {
+	Id      int    `json:"id"`
+	Address string `json:"address"`
+	Store   string `json:"store,omitempty"` // directory keeping the node's pages across restarts, none if empty
+}
+
+// PageConfig places a page on its first owner, which starts with write access to it
+type PageConfig struct {
+	PageNum int    `json:"page"`
+	Owner   int    `json:"owner"`
+	Content string `json:"content"`
+	Policy  string `json:"policy,omitempty"` // "invalidate" (the default) or "update", see PolicyUpdate
+}
+
+// LoadConfig reads a cluster config from a JSON file and validates it
+func LoadConfig(path string) (*ClusterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ClusterConfig{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Validate checks that ids and addresses are unique, that the primary is one of the CMs and that
+// every page has a positive number, is owned by one of the nodes and has a known policy
+func (config *ClusterConfig) Validate() error {
+	if config.Manager != "" && config.Manager != ManagerCentral && config.Manager != ManagerFixed && config.Manager != ManagerDynamic {
+		return fmt.Errorf("unknown manager %q, expected %s, %s or %s", config.Manager, ManagerCentral, ManagerFixed, ManagerDynamic)
+	}
+	if len(config.CMs) == 0 && !config.NodesManage() {
+		return fmt.Errorf("no CMs configured")
+	}
+	if len(config.Nodes) == 0 {
+		return fmt.Errorf("no nodes configured")
+	}
+
+	addresses := map[string]bool{}
+	checkAddress := func(kind string, id int, address string) error {
+		if address == "" {
+			return fmt.Errorf("%s %d has no address", kind, id)
+		}
+		if addresses[address] {
+			return fmt.Errorf("%s %d: address %s is used twice", kind, id, address)
+		}
+		addresses[address] = true
+		return nil
+	}
+
+	cmIds := map[int]bool{}
+	for _, cm := range config.CMs {
+		if cmIds[cm.Id] {
+			return fmt.Errorf("CM id %d is used twice", cm.Id)
+		}
+		cmIds[cm.Id] = true
+		if err := checkAddress("CM", cm.Id, cm.Address); err != nil {
+			return err
+		}
+	}
+	if len(config.CMs) > 0 && !cmIds[config.Primary] {
+		return fmt.Errorf("primary %d is not one of the CMs", config.Primary)
+	}
+
+	nodeIds := map[int]bool{}
+	for _, node := range config.Nodes {
+		if node.Id <= 0 {
+			// 0 is what a node asks for when it joins and lets the CM pick its id
+			return fmt.Errorf("node id %d is not positive", node.Id)
+		}
+		if nodeIds[node.Id] {
+			return fmt.Errorf("node id %d is used twice", node.Id)
+		}
+		nodeIds[node.Id] = true
+		if err := checkAddress("node", node.Id, node.Address); err != nil {
+			return err
+		}
+	}
+
+	pageNums := map[int]bool{}
+	for _, page := range config.Pages {
+		if page.PageNum <= 0 {
+			return fmt.Errorf("page number %d is not positive", page.PageNum)
+		}
+		if pageNums[page.PageNum] {
+			return fmt.Errorf("page %d is configured twice", page.PageNum)
+		}
+		pageNums[page.PageNum] = true
+		if !nodeIds[page.Owner] {
+			return fmt.Errorf("page %d is owned by unknown node %d", page.PageNum, page.Owner)
+		}
+		if err := checkPolicy(config.Manager, page.Policy); err != nil {
+			return fmt.Errorf("page %d: %w", page.PageNum, err)
+		}
+	}
+	return nil
+}
+
+// NodesManage reports whether the nodes manage the pages instead of the CMs
+func (config *ClusterConfig) NodesManage() bool {
+	return nodesManage(config.Manager)
+}
+
+// Managers returns the ids of the nodes that manage the pages in id order, nil if the CMs manage them
+func (config *ClusterConfig) Managers() []int {
+	if !config.NodesManage() {
+		return nil
+	}
+	ids := []int{}
+	for _, node := range config.Nodes {
+		ids = append(ids, node.Id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// PageManager returns the id of the node that manages a page, if the nodes manage the pages
+func (config *ClusterConfig) PageManager(pageNum int) int {
+	return managerOf(config.Managers(), pageNum)
+}
+
+// CMAddrs returns the address of every CM by id
+func (config *ClusterConfig) CMAddrs() map[int]string {
+	addrs := map[int]string{}
+	for _, cm := range config.CMs {
+		addrs[cm.Id] = cm.Address
+	}
+	return addrs
+}
+
+// NodeAddrs returns the address of every node by id
+func (config *ClusterConfig) NodeAddrs() map[int]string {
+	addrs := map[int]string{}
+	for _, node := range config.Nodes {
+		addrs[node.Id] = node.Address
+	}
+	return addrs
+}
+
+// HasCM reports whether a CM with the id is configured
+func (config *ClusterConfig) HasCM(id int) bool {
+	_, ok := config.CMAddrs()[id]
+	return ok
+}
+
+// HasNode reports whether a node with the id is configured
+func (config *ClusterConfig) HasNode(id int) bool {
+	_, ok := config.NodeAddrs()[id]
+	return ok
+}
+
+// CMWAL returns the write-ahead log directory of a CM, "" if it has none
+func (config *ClusterConfig) CMWAL(cmId int) string {
+	for _, cm := range config.CMs {
+		if cm.Id == cmId {
+			return cm.WAL
+		}
+	}
+	return ""
+}
+
+// NodeStore returns the page store directory of a node, "" if it has none
+func (config *ClusterConfig) NodeStore(nodeId int) string {
+	for _, node := range config.Nodes {
+		if node.Id == nodeId {
+			return node.Store
+		}
+	}
+	return ""
+}
+
+// PageRecords returns the CM's page table for the initial placement, in page order
+func (config *ClusterConfig) PageRecords() []*PageRecord {
+	pages := append([]PageConfig{}, config.Pages...)
+	sort.Slice(pages, func(i, j int) bool { return pages[i].PageNum < pages[j].PageNum })
+
+	pageRecords := []*PageRecord{}
+	for _, page := range pages {
+		pageRecords = append(pageRecords, &PageRecord{PageNum: page.PageNum, CopySet: []int{}, Owner: page.Owner, Policy: page.Policy})
+	}
+	return pageRecords
+}
+
+// NodePages returns the pages a node starts out owning, with write access
+func (config *ClusterConfig) NodePages(nodeId int) []*Page {
+	pages := []*Page{}
+	for _, page := range config.Pages {
+		if page.Owner == nodeId {
+			pages = append(pages, &Page{PageNum: page.PageNum, Content: page.Content, Access: WRITE})
+		}
+	}
+	return pages
+}
+
+// InitialContents returns the content every configured page starts out with, for CheckHistory
+func (config *ClusterConfig) InitialContents() map[int]string {
+	initial := map[int]string{}
+	for _, page := range config.Pages {
+		initial[page.PageNum] = page.Content
+	}
+	return initial
+}
@@ -8,4 +8,6 @@ const (
 	INVALIDATE
 	READCONFIRM
 	WRITECONFIRM
+	FREE
+	ALLOCATE
 )
@@ -0,0 +1,559 @@
+package ivy
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// under the dynamic distributed manager from Li & Hudak there is no manager on the fault path. Every
+// node keeps a probable owner for each page, and a fault is sent to it and forwarded from node to
+// node until it reaches the owner. A node that forwards a write request points its probable owner
+// at the writer, which is about to own the page, and the owner's id comes back down the chain of a
+// read request, so the chains shrink as they are used. The owner keeps the copy set, and a writer
+// that takes a page over invalidates the copies
+
+const (
+	ownerHopTimeout = time.Second // a forward waits this long for every hop the request may still take
+	acceptedPerPage = 16          // request ids a node remembers per page to recognize a copy sent again
+)
+
+// ownership is what a node knows about one page under the dynamic distributed manager
+type ownership struct {
+	probOwner  int                 // the node this node thinks owns the page, its own id if it does
+	copySet    []int               // nodes with a read copy, kept by the owner
+	serving    bool                // the node is sending the page to a requester as its owner
+	requesting bool                // the node's own request for the page is on its way
+	waiting    []*OwnerRequestArgs // requests that arrived while the node was serving or requesting
+	accepted   []acceptedRequest   // the last requests the node queued, served or passed on
+}
+
+// acceptedRequest is a request a node took after it had been forwarded hops times. A copy sent
+// again by the requester gets to the node after as many hops, while the request itself can come
+// by again after more hops if the chain changed under it
+type acceptedRequest struct {
+	id   string
+	hops int
+}
+
+// accept remembers that the node took a request, so that a copy of it is not routed again
+func (own *ownership) accept(args *OwnerRequestArgs) {
+	if own.hasAccepted(args) {
+		return
+	}
+	own.accepted = append(own.accepted, acceptedRequest{id: args.RequestId, hops: args.Hops})
+	if len(own.accepted) > acceptedPerPage {
+		own.accepted = own.accepted[1:]
+	}
+}
+
+func (own *ownership) hasAccepted(args *OwnerRequestArgs) bool {
+	for _, accepted := range own.accepted {
+		if accepted.id == args.RequestId && accepted.hops == args.Hops {
+			return true
+		}
+	}
+	return false
+}
+
+var errFreeUnsupported = errors.New("pages cannot be freed under the dynamic distributed manager")
+
+// ManageDynamically makes the node find page owners through probable owner chains, in place of the
+// CMs. nodes are the ids of every node and pageRecords the initial owners of the pages. A page the
+// node has not heard of is looked for first at nodes[p % len(nodes)], the node that allocates it.
+// It must be called before Start
+func (node *Node) ManageDynamically(nodes []int, pageRecords []*PageRecord) {
+	node.allocators = append([]int{}, nodes...)
+	sort.Ints(node.allocators)
+
+	node.ownership = map[int]*ownership{}
+	for _, pr := range pageRecords {
+		own := &ownership{probOwner: pr.Owner}
+		if pr.Owner == node.Id {
+			own.copySet = append([]int{}, pr.CopySet...)
+		}
+		node.ownership[pr.PageNum] = own
+	}
+}
+
+// pageOwnership returns what the node knows about a page. node.lock must be held
+func (node *Node) pageOwnership(pageNum int) *ownership {
+	own := node.ownership[pageNum]
+	if own == nil {
+		own = &ownership{probOwner: managerOf(node.allocators, pageNum)}
+		node.ownership[pageNum] = own
+	}
+	return own
+}
+
+// findPage returns the node's copy of a page, nil if it has none. node.lock must be held
+func (node *Node) findPage(pageNum int) *Page {
+	for _, page := range node.Pages {
+		if page.PageNum == pageNum {
+			return page
+		}
+	}
+	return nil
+}
+
+// requestFromOwner starts the node's own request for a page down the probable owner chain. It is
+// sent again, up to sendAttempts times, if it does not get to a node that takes it. The nodes it
+// got to the first time answer a copy without passing it on
+func (node *Node) requestFromOwner(request *Request) error {
+	if request.Id == "" {
+		request.Id = node.newRequestId()
+	}
+	defer node.span("OwnerRequest", request.Id, request.PageNum, node.Id)()
+
+	args := &OwnerRequestArgs{PageNum: request.PageNum, RequesterId: node.Id, RequestId: request.Id, TypeOfReq: request.TypeOfReq, Clock: node.clock.tick()}
+	node.log().Info("Sending request to probable owner", "page", request.PageNum, "request", request.Id, "type", request.TypeOfReq, "clock", args.Clock)
+	var err error
+	for attempt := 0; attempt < sendAttempts; attempt++ {
+		_, err = node.routeOwnerRequest(args)
+		if err == nil {
+			return nil
+		}
+		node.log().Warn("Error sending request to probable owner", "page", request.PageNum, "request", request.Id, "attempt", attempt, "err", err)
+	}
+	return err
+}
+
+// OwnerRequest is a RPC method that is called by another node to pass on a read or write request
+// for a page. The call returns once the request is queued, served or forwarded, with the owner of
+// the page if the request got to it
+func (node *Node) OwnerRequest(args *OwnerRequestArgs, res *OwnerRequestResponse) error {
+	clock := node.clock.witness(args.Clock)
+	node.log().Info("Received owner request", "page", args.PageNum, "requester", args.RequesterId, "request", args.RequestId, "hops", args.Hops, "clock", clock)
+	defer func() { res.Clock = node.clock.tick() }()
+
+	node.lock.Lock()
+	own := node.pageOwnership(args.PageNum)
+	if own.hasAccepted(args) {
+		// a copy sent again after the answer to the first one was lost
+		if own.probOwner == node.Id {
+			res.OwnerId = node.Id
+		}
+		node.lock.Unlock()
+		return nil
+	}
+	node.lock.Unlock()
+
+	ownerId, err := node.routeOwnerRequest(args)
+	res.OwnerId = ownerId
+	return err
+}
+
+// routeOwnerRequest serves a request if this node owns the page, and otherwise forwards it to the
+// probable owner. A request that arrives while the node is busy with the page waits for it. It
+// returns the owner of the page if the request got to it, and 0 if it is waiting at another node.
+// A request forwarded more often than twice the number of nodes is failed, the chain it follows
+// keeps changing or goes round in a circle
+func (node *Node) routeOwnerRequest(args *OwnerRequestArgs) (int, error) {
+	node.lock.Lock()
+	own := node.pageOwnership(args.PageNum)
+	if own.serving || (own.requesting && args.RequesterId != node.Id) {
+		own.waiting = append(own.waiting, args)
+		own.accept(args)
+		ownerId := 0
+		if own.serving {
+			ownerId = node.Id
+		}
+		node.lock.Unlock()
+		return ownerId, nil
+	}
+	if args.RequesterId == node.Id {
+		own.requesting = true
+	}
+	if own.probOwner == node.Id {
+		own.serving = true
+		own.accept(args)
+		node.lock.Unlock()
+		spawn(node.transport, func() { node.serveOwnerRequest(args) })
+		return node.Id, nil
+	}
+	maxHops := 2 * len(node.allocators)
+	if args.Hops >= maxHops {
+		node.lock.Unlock()
+		return 0, fmt.Errorf("request for page %d forwarded %d times without getting to the owner", args.PageNum, args.Hops)
+	}
+	next := own.probOwner
+	pointed := false
+	if args.TypeOfReq == WRITE && args.RequesterId != node.Id {
+		// the writer is about to own the page
+		own.probOwner = args.RequesterId
+		pointed = true
+	}
+	node.lock.Unlock()
+
+	defer node.span("ForwardOwnerRequest", args.RequestId, args.PageNum, args.RequesterId)()
+	node.metrics.ownerForwards.inc()
+	forward := *args
+	forward.Hops++
+	forward.Clock = node.clock.tick()
+	res := &OwnerRequestResponse{}
+	node.log().Info("Forwarding owner request", "page", args.PageNum, "to", next, "requester", args.RequesterId, "request", args.RequestId, "clock", forward.Clock)
+	// the hops further down the chain time out first, so their error comes back before this one
+	timeout := time.Duration(maxHops-args.Hops) * ownerHopTimeout
+	err := node.transport.Call(node.nodeAddress(next), "Node.OwnerRequest", &forward, res, timeout)
+
+	node.lock.Lock()
+	own = node.pageOwnership(args.PageNum)
+	if err != nil {
+		if pointed && own.probOwner == args.RequesterId {
+			// the writer will not own the page, and its own probable owner may point back here
+			own.probOwner = next
+		}
+		node.lock.Unlock()
+		node.log().Warn("Error forwarding owner request", "page", args.PageNum, "to", next, "err", err)
+		return 0, err
+	}
+	if args.TypeOfReq == READ && res.OwnerId != 0 && own.probOwner == next {
+		// the rest of the chain is skipped from now on
+		own.probOwner = res.OwnerId
+	}
+	own.accept(args)
+	node.lock.Unlock()
+	node.clock.witness(res.Clock)
+	return res.OwnerId, nil
+}
+
+// serveOwnerRequest sends the page to the requester as its owner. A reader is added to the copy set,
+// a writer gets the copy set and becomes the owner. If the requester turns the page down this
+// node keeps it and the request fails. A writer that does not answer is sent the page until it does
+func (node *Node) serveOwnerRequest(args *OwnerRequestArgs) {
+	defer node.doneServing(args.PageNum)
+	defer node.span("ServeOwnerRequest", args.RequestId, args.PageNum, args.RequesterId)()
+
+	node.lock.Lock()
+	page := node.findPage(args.PageNum)
+	if page == nil {
+		node.lock.Unlock()
+		node.failOwnerRequest(args, fmt.Errorf("page %d not found", args.PageNum))
+		return
+	}
+	own := node.pageOwnership(args.PageNum)
+	sendArgs := &SendPageArgs{PageNum: args.PageNum, Content: page.Content, OwnerId: node.Id, RequestId: args.RequestId, Clock: node.clock.tick()}
+	access := page.Access
+	// a reader that already has a copy from an earlier request keeps it if it turns this one down
+	added := false
+	if args.TypeOfReq == READ {
+		node.metrics.readForwards.inc()
+		page.Access = READ
+		node.persist(page)
+		if !containsNode(own.copySet, args.RequesterId) {
+			own.copySet = append(own.copySet, args.RequesterId)
+			added = true
+		}
+	} else {
+		node.metrics.writeForwards.inc()
+		sendArgs.CopySet = append([]int{}, own.copySet...)
+		if args.RequesterId != node.Id {
+			// nothing may read the copy once the new owner writes, it is kept until the page is taken
+			page.Access = handingOver
+		}
+	}
+	node.lock.Unlock()
+	node.log().Info("Serving owner request", "page", args.PageNum, "requester", args.RequesterId, "request", args.RequestId, "hops", args.Hops)
+
+	if args.RequesterId == node.Id {
+		// the owner upgrading its own read copy
+		node.handleSendPage(sendArgs)
+		return
+	}
+	res := &SendPageResponse{}
+	err := node.callNode(args.RequesterId, "Node.SendPage", sendArgs, res, sendPageTimeout)
+	_, refused := err.(rpc.ServerError)
+	for args.TypeOfReq == WRITE && err != nil && !refused {
+		// the writer may have taken the page, so this node can neither write it again nor hand
+		// it to another node until the writer answers
+		node.log().Warn("No answer from the writer, sending the page again", "page", args.PageNum, "requester", args.RequesterId, "err", err)
+		<-after(node.transport, retryInterval)
+		err = node.callNode(args.RequesterId, "Node.SendPage", sendArgs, res, sendPageTimeout)
+		_, refused = err.(rpc.ServerError)
+	}
+
+	node.lock.Lock()
+	page = node.findPage(args.PageNum)
+	if err != nil {
+		// a reader that did not answer may have its copy, it stays in the copy set
+		if args.TypeOfReq == READ && added && refused {
+			own.copySet = removeNode(own.copySet, args.RequesterId)
+		} else if page != nil && page.Access == handingOver {
+			page.Access = access
+		}
+	} else if args.TypeOfReq == WRITE {
+		own.probOwner = args.RequesterId
+		own.copySet = nil
+		if page != nil && page.Access == handingOver {
+			node.dropPage(args.PageNum)
+		}
+	}
+	node.lock.Unlock()
+
+	if err != nil {
+		node.log().Warn("Requester did not take the page", "page", args.PageNum, "requester", args.RequesterId, "err", err)
+		node.failOwnerRequest(args, err)
+		return
+	}
+	node.clock.witness(res.Clock)
+}
+
+// dropPage removes the node's copy of a page. node.lock must be held
+func (node *Node) dropPage(pageNum int) {
+	newPages := []*Page{}
+	for _, page := range node.Pages {
+		if page.PageNum != pageNum {
+			newPages = append(newPages, page)
+		}
+	}
+	node.Pages = newPages
+	node.unpersist(pageNum)
+}
+
+func removeNode(nodes []int, nodeId int) []int {
+	kept := []int{}
+	for _, id := range nodes {
+		if id != nodeId {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// takePage installs a page sent by its owner. A reader keeps a copy and remembers the owner, a
+// writer invalidates the copies it was handed and owns the page from now on. If a copy cannot be
+// invalidated the writer still owns the page, read only and with that copy left in its copy set,
+// and the write fails
+func (node *Node) takePage(request *Request, args *SendPageArgs) {
+	var err error
+	if request.TypeOfReq == READ {
+		node.lock.Lock()
+		node.installPage(args.PageNum, args.Content, READ)
+		node.pageOwnership(args.PageNum).probOwner = args.OwnerId
+		request.Content = args.Content
+		node.currentRequest = nil
+		node.lock.Unlock()
+	} else {
+		var acked []int
+		copySet := removeNode(args.CopySet, node.Id)
+		acked, err = node.invalidateCopies(request, copySet)
+
+		node.lock.Lock()
+		own := node.pageOwnership(args.PageNum)
+		own.probOwner = node.Id
+		own.copySet = []int{}
+		for _, nodeId := range copySet {
+			if !containsNode(acked, nodeId) {
+				own.copySet = append(own.copySet, nodeId)
+			}
+		}
+		if err == nil {
+			node.persist(node.installPage(args.PageNum, request.Content, WRITE))
+		} else {
+			node.persist(node.installPage(args.PageNum, args.Content, READ))
+		}
+		node.currentRequest = nil
+		node.lock.Unlock()
+	}
+	spawn(node.transport, func() { request.done <- err })
+}
+
+// invalidateCopies asks every node in copySet at the same time to drop its copy of the page of request.
+// It returns the nodes that acknowledged, and an error listing the ones that did not
+func (node *Node) invalidateCopies(request *Request, copySet []int) ([]int, error) {
+	errs := make([]error, len(copySet))
+	var wg sync.WaitGroup
+	for i, nodeId := range copySet {
+		wg.Add(1)
+		spawn(node.transport, func() {
+			defer wg.Done()
+			defer node.span("Invalidate", request.Id, request.PageNum, node.Id)()
+			req := &InvalidateArgs{PageNum: request.PageNum, RequesterId: node.Id, RequestId: request.Id, Clock: node.clock.tick()}
+			res := &InvalidateResponse{}
+			errs[i] = node.transport.Call(node.nodeAddress(nodeId), "Node.Invalidate", req, res, invalidateTimeout)
+			if errs[i] == nil {
+				node.clock.witness(res.Clock)
+			}
+		})
+	}
+	wg.Wait()
+
+	acked := []int{}
+	failed := []int{}
+	for i, nodeId := range copySet {
+		if errs[i] != nil {
+			node.log().Warn("Invalidate failed", "page", request.PageNum, "to", nodeId, "err", errs[i])
+			failed = append(failed, nodeId)
+		} else {
+			acked = append(acked, nodeId)
+		}
+	}
+	if len(failed) > 0 {
+		return acked, fmt.Errorf("invalidation of page %d not acknowledged by nodes %v", request.PageNum, failed)
+	}
+	return acked, nil
+}
+
+// failOwnerRequest tells the requester that its request could not be served
+func (node *Node) failOwnerRequest(args *OwnerRequestArgs, reason error) {
+	req := &RequestFailedArgs{PageNum: args.PageNum, TypeOfReq: args.TypeOfReq, Reason: reason.Error(), RequestId: args.RequestId, Clock: node.clock.tick()}
+	res := &RequestFailedResponse{}
+	if args.RequesterId == node.Id {
+		node.RequestFailed(req, res)
+		return
+	}
+	err := node.callNode(args.RequesterId, "Node.RequestFailed", req, res, sendPageTimeout)
+	if err != nil {
+		node.log().Warn("Error calling RequestFailed", "page", args.PageNum, "requester", args.RequesterId, "err", err)
+	}
+}
+
+// callNode calls another node until it answers or sendAttempts calls have failed. An error
+// returned by the node itself is not tried again. The calls it is used for are recognized by
+// their request id when they arrive twice
+func (node *Node) callNode(nodeId int, method string, args any, reply any, timeout time.Duration) error {
+	var err error
+	for attempt := 0; attempt < sendAttempts; attempt++ {
+		err = node.transport.Call(node.nodeAddress(nodeId), method, args, reply, timeout)
+		if _, refused := err.(rpc.ServerError); err == nil || refused {
+			return err
+		}
+	}
+	return err
+}
+
+// doneServing lets the requests that waited for the owner to finish go on
+func (node *Node) doneServing(pageNum int) {
+	node.lock.Lock()
+	node.pageOwnership(pageNum).serving = false
+	node.lock.Unlock()
+	spawn(node.transport, func() { node.drain(pageNum) })
+}
+
+// doneRequesting lets the requests that waited for the node's own request go on
+func (node *Node) doneRequesting(pageNum int) {
+	node.lock.Lock()
+	node.pageOwnership(pageNum).requesting = false
+	node.lock.Unlock()
+	spawn(node.transport, func() { node.drain(pageNum) })
+}
+
+// drain routes the requests that are waiting for a page, until the node is busy with it again
+func (node *Node) drain(pageNum int) {
+	for {
+		node.lock.Lock()
+		own := node.pageOwnership(pageNum)
+		if own.serving || own.requesting || len(own.waiting) == 0 {
+			node.lock.Unlock()
+			return
+		}
+		args := own.waiting[0]
+		own.waiting = own.waiting[1:]
+		node.lock.Unlock()
+
+		if _, err := node.routeOwnerRequest(args); err != nil {
+			node.failOwnerRequest(args, err)
+		}
+	}
+}
+
+// allocateOwnPage creates a new page owned by this node. The node only hands out the page numbers
+// that other nodes look for at it
+func (node *Node) allocateOwnPage() int {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	pageNum := 1
+	for num := range node.ownership {
+		if num >= pageNum {
+			pageNum = num + 1
+		}
+	}
+	for managerOf(node.allocators, pageNum) != node.Id {
+		pageNum++
+	}
+	node.ownership[pageNum] = &ownership{probOwner: node.Id, copySet: []int{}}
+	node.persist(node.installPage(pageNum, "", WRITE))
+	return pageNum
+}
+
+// OwnerInfo is a RPC method that returns the node's probable owner of a page, and the copy set and
+// the number of waiting requests if the node owns it
+func (node *Node) OwnerInfo(args *PageInfoArgs, res *PageInfoResponse) error {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	// a page the node has not heard of is not added, so that it does not count for allocateOwnPage
+	own := node.ownership[args.PageNum]
+	if own == nil {
+		own = &ownership{probOwner: managerOf(node.allocators, args.PageNum)}
+	}
+	res.PageNum = args.PageNum
+	res.Owner = own.probOwner
+	if own.probOwner == node.Id {
+		if node.findPage(args.PageNum) == nil {
+			return fmt.Errorf("page %d not found", args.PageNum)
+		}
+		res.CopySet = append([]int{}, own.copySet...)
+		res.Waiting = len(own.waiting)
+	}
+	return nil
+}
+
+// OwnedPages is a RPC method that returns the pages this node owns
+func (node *Node) OwnedPages(args *ListPagesArgs, res *ListPagesResponse) error {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	res.Pages = []PageInfoResponse{}
+	for pageNum, own := range node.ownership {
+		if own.probOwner == node.Id && node.findPage(pageNum) != nil {
+			res.Pages = append(res.Pages, PageInfoResponse{PageNum: pageNum, Owner: node.Id, CopySet: append([]int{}, own.copySet...), Waiting: len(own.waiting)})
+		}
+	}
+	sort.Slice(res.Pages, func(i, j int) bool { return res.Pages[i].PageNum < res.Pages[j].PageNum })
+	return nil
+}
+
+// FindOwner follows the probable owner chain of a page from the node at start to the owner and
+// returns what the owner has on record
+func FindOwner(transport Transport, nodeAddr map[int]string, start int, pageNum int) (*PageInfoResponse, error) {
+	nodeId := start
+	// a chain is never longer than the number of nodes, unless it changes while it is followed
+	for hops := 0; hops <= 2*len(nodeAddr); hops++ {
+		res := &PageInfoResponse{}
+		err := transport.Call(nodeAddr[nodeId], "Node.OwnerInfo", &PageInfoArgs{PageNum: pageNum}, res, cmCallTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("node %d: %w", nodeId, err)
+		}
+		if res.Owner == nodeId {
+			return res, nil
+		}
+		nodeId = res.Owner
+	}
+	return nil, fmt.Errorf("no owner found for page %d", pageNum)
+}
+
+// ListOwnedPages asks every node for the pages it owns and returns them in page order
+func ListOwnedPages(transport Transport, nodeAddr map[int]string) ([]PageInfoResponse, error) {
+	nodeIds := []int{}
+	for nodeId := range nodeAddr {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	sort.Ints(nodeIds)
+
+	pages := []PageInfoResponse{}
+	for _, nodeId := range nodeIds {
+		res := &ListPagesResponse{}
+		err := transport.Call(nodeAddr[nodeId], "Node.OwnedPages", &ListPagesArgs{}, res, cmCallTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("node %d: %w", nodeId, err)
+		}
+		pages = append(pages, res.Pages...)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].PageNum < pages[j].PageNum })
+	return pages, nil
+}
@@ -0,0 +1,151 @@
+package ivy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Operation is one read or write made through the node API, with the times it was invoked and
+// returned. A read's Value is what it returned, a write's Value is what it wrote
+type Operation struct {
+	Client  int    `json:"client"` // id of the node that made the operation
+	Kind    string `json:"kind"`   // "read" or "write"
+	PageNum int    `json:"page"`
+	Value   string `json:"value"`
+	Invoke  int64  `json:"invoke"` // unix nanoseconds
+	Return  int64  `json:"return"`
+	Ok      bool   `json:"ok"` // false if the operation failed, a failed write may still have taken effect
+}
+
+func (op Operation) String() string {
+	status := ""
+	if !op.Ok {
+		status = " (failed)"
+	}
+	return fmt.Sprintf("node %d %s page %d %q [%d, %d]%s", op.Client, op.Kind, op.PageNum, op.Value, op.Invoke, op.Return, status)
+}
+
+// History records the operations of a node. With a file every operation is written to it as one
+// JSON line when it returns, so the operations of a process that crashes are kept
+type History struct {
+	lock       sync.Mutex
+	operations []Operation
+	file       *os.File
+}
+
+func NewHistory() *History {
+	return &History{}
+}
+
+// OpenHistory creates a history that also appends its operations to the file at path. A node that
+// restarts after a crash adds to what it wrote before, with the torn last line cut off
+func OpenHistory(path string) (*History, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if end := bytes.LastIndexByte(data, '\n') + 1; end < len(data) {
+		if err := os.Truncate(path, int64(end)); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &History{file: file}, nil
+}
+
+// record adds an operation, a nil history records nothing
+func (history *History) record(op Operation) {
+	if history == nil {
+		return
+	}
+	history.lock.Lock()
+	defer history.lock.Unlock()
+
+	history.operations = append(history.operations, op)
+	if history.file == nil {
+		return
+	}
+	data, err := json.Marshal(op)
+	if err != nil {
+		return
+	}
+	if _, err := history.file.Write(append(data, '\n')); err != nil {
+		logger.Error("Error writing history", "file", history.file.Name(), "err", err)
+	}
+}
+
+// Operations returns the operations recorded so far
+func (history *History) Operations() []Operation {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	return append([]Operation{}, history.operations...)
+}
+
+func (history *History) Close() error {
+	if history.file == nil {
+		return nil
+	}
+	return history.file.Close()
+}
+
+// LoadHistory reads the history files written by several nodes. A torn last line, from a node
+// that crashed while writing it, is skipped
+func LoadHistory(paths []string) ([]Operation, error) {
+	operations := []Operation{}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		line := 0
+		var torn error
+		for scanner.Scan() {
+			line++
+			if torn != nil {
+				file.Close()
+				return nil, torn
+			}
+			var op Operation
+			if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+				torn = fmt.Errorf("%s:%d: %w", path, line, err)
+				continue
+			}
+			operations = append(operations, op)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(operations, func(i, j int) bool { return operations[i].Invoke < operations[j].Invoke })
+	return operations, nil
+}
+
+// RecordHistory makes the node record every ReadPage and WritePage in history
+func (node *Node) RecordHistory(history *History) {
+	node.history = history
+}
+
+func (node *Node) recordOp(kind string, pageNum int, value string, invoke time.Time, err error) {
+	node.history.record(Operation{
+		Client:  node.Id,
+		Kind:    kind,
+		PageNum: pageNum,
+		Value:   value,
+		Invoke:  invoke.UnixNano(),
+		Return:  now(node.transport).UnixNano(),
+		Ok:      err == nil,
+	})
+}
@@ -2,8 +2,53 @@ package ivy
 
 import (
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
 )
 
-func logInfo(msg string) {
-	fmt.Println(msg)
+// the package logs through log/slog. CMs and nodes log with their id attached, see CentralManager.log
+// and Node.log, and protocol messages carry the page, the nodes involved and the Lamport clock as
+// fields. Logs go to stderr unless SetLogOutput says otherwise, apart from the REPL on stdout
+var (
+	logLevel = new(slog.LevelVar) // info unless SetLogLevel is called
+	logger   = newLogger(os.Stderr, "text")
+)
+
+func newLogger(w io.Writer, format string) *slog.Logger {
+	options := &slog.HandlerOptions{Level: logLevel}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+// SetLogLevel sets the lowest level that is logged: "debug", "info", "warn" or "error"
+func SetLogLevel(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", level)
+	}
+	logLevel.Set(l)
+	return nil
+}
+
+// SetLogOutput sends the logs to w, formatted as "text" (key=value pairs) or "json" (one object per line)
+func SetLogOutput(w io.Writer, format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q, expected text or json", format)
+	}
+	logger = newLogger(w, format)
+	return nil
+}
+
+// log returns the logger of the CM, which adds the CM's id to every message
+func (cm *CentralManager) log() *slog.Logger {
+	return logger.With("cm", cm.Id)
+}
+
+// log returns the logger of the node, which adds the node's id to every message. A node that joins
+// with id 0 gets its id from the CM, so the logger is not kept
+func (node *Node) log() *slog.Logger {
+	return logger.With("node", node.Id)
 }
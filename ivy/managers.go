@@ -0,0 +1,92 @@
+package ivy
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sort"
+)
+
+// manager modes of a cluster, see ClusterConfig.Manager. With the fixed distributed manager from
+// Li & Hudak every node manages a share of the pages in place of the CMs, so that the page table
+// is no longer kept in one place. With the dynamic distributed manager there is no page table at
+// all, see dynamic.go
+const (
+	ManagerCentral = "central" // the CMs manage every page
+	ManagerFixed   = "fixed"   // page p is managed by the node at index p mod N of the N nodes in id order
+	ManagerDynamic = "dynamic" // the nodes find the owner of a page through probable owner hints
+)
+
+var errFixedMembership = errors.New("the nodes are fixed when they manage the pages")
+
+// nodesManage reports whether the nodes manage the pages in a manager mode, with no CMs needed
+func nodesManage(mode string) bool {
+	return mode == ManagerFixed || mode == ManagerDynamic
+}
+
+// managerOf returns the id of the node that manages a page
+func managerOf(managers []int, pageNum int) int {
+	return managers[pageNum%len(managers)]
+}
+
+// ManagePages makes the node one of the page managers, in place of the CMs. managers are the ids of
+// every node and pageRecords the records of every page. The node keeps the records of the pages it
+// manages in a CentralManager of its own, which is served next to the node under the same name as
+// a CM. It must be called before Start
+func (node *Node) ManagePages(managers []int, pageRecords []*PageRecord) {
+	node.managers = append([]int{}, managers...)
+	sort.Ints(node.managers)
+
+	records := []*PageRecord{}
+	for _, pr := range pageRecords {
+		if managerOf(node.managers, pr.PageNum) == node.Id {
+			records = append(records, pr)
+		}
+	}
+	peers := map[int]string{node.Id: node.Nodeaddr[node.Id]}
+	node.manager = NewCentralManager(node.Id, 0, node.Nodeaddr, records, peers, node.Id, node.transport)
+	node.manager.stride = len(node.managers)
+	for i, id := range node.managers {
+		if id == node.Id {
+			node.manager.offset = i
+		}
+	}
+}
+
+// callManager makes an RPC call to the manager of a page: the node that manages it if the nodes
+// manage the pages, the current CM otherwise. A node that cannot be reached is tried again, as
+// there is no other manager for the page
+func (node *Node) callManager(pageNum int, method string, args any, reply any) error {
+	if node.managers == nil {
+		return node.callCM(method, args, reply)
+	}
+	managerId := managerOf(node.managers, pageNum)
+	var err error
+	for attempt := 0; attempt < cmRetryRounds; attempt++ {
+		if attempt > 0 {
+			node.restamp(args)
+		}
+		err = node.transport.Call(node.nodeAddress(managerId), method, args, reply, cmCallTimeout)
+		if _, refused := err.(rpc.ServerError); err == nil || refused {
+			return err
+		}
+		node.log().Warn("Page manager unavailable, retrying", "manager", managerId, "page", pageNum, "err", err)
+		<-after(node.transport, cmRetryDelay)
+	}
+	return err
+}
+
+// listManagedPages asks every manager for its pages and returns them in page order
+func (node *Node) listManagedPages() ([]PageInfoResponse, error) {
+	pages := []PageInfoResponse{}
+	for _, managerId := range node.managers {
+		res := &ListPagesResponse{}
+		err := node.transport.Call(node.nodeAddress(managerId), "CentralManager.ListPages", &ListPagesArgs{}, res, cmCallTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("manager %d: %w", managerId, err)
+		}
+		pages = append(pages, res.Pages...)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].PageNum < pages[j].PageNum })
+	return pages, nil
+}
@@ -0,0 +1,273 @@
+package ivy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// nodeAddress returns the address of a member node, or "" if it is not a member
+func (cm *CentralManager) nodeAddress(nodeId int) string {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	return cm.nodeAddr[nodeId]
+}
+
+// members returns a copy of the membership and its version. cm.lock must be held
+func (cm *CentralManager) members() (map[int]string, int) {
+	members := map[int]string{}
+	for id, address := range cm.nodeAddr {
+		members[id] = address
+	}
+	return members, cm.membersVersion
+}
+
+// setMembers replaces the membership with one replicated from the primary if it is newer
+func (cm *CentralManager) setMembers(members map[int]string, version int) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if version <= cm.membersVersion {
+		return nil
+	}
+	cm.nodeAddr = map[int]string{}
+	for id, address := range members {
+		cm.nodeAddr[id] = address
+	}
+	cm.membersVersion = version
+	return cm.logMembers()
+}
+
+// membershipChanged passes a new membership on to the backups, and then to every member but skipId
+// in the background. It fails if the backups did not get it, see sendReplicate
+func (cm *CentralManager) membershipChanged(members map[int]string, version int, skipId int) error {
+	if err := cm.sendReplicate(ReplicateArgs{Members: members, MembersVersion: version}, "membership"); err != nil {
+		return err
+	}
+
+	ids := []int{}
+	for id := range members {
+		if id != skipId {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, nodeId := range ids {
+		address := members[nodeId]
+		spawn(cm.transport, func() {
+			req := &MembershipArgs{Members: members, MembersVersion: version, Clock: cm.clock.tick()}
+			res := &MembershipResponse{}
+			err := cm.transport.Call(address, "Node.UpdateMembership", req, res, invalidateTimeout)
+			if err != nil {
+				cm.log().Warn("Error sending membership", "to", nodeId, "version", version, "err", err)
+				return
+			}
+			cm.clock.witness(res.Clock)
+		})
+	}
+	return nil
+}
+
+// Join rpc called by a node that wants to take part in the cluster. A node that asks for id 0 gets
+// the id already registered for its address, or a new one. The reply carries every member's address
+func (cm *CentralManager) Join(args *JoinArgs, res *JoinResponse) error {
+	if err := cm.checkPrimary(); err != nil {
+		return err
+	}
+	clock := cm.clock.witness(args.Clock)
+	defer func() { res.Clock = cm.clock.tick() }()
+
+	cm.lock.Lock()
+	nodeId := args.NodeId
+	if nodeId == 0 {
+		for id, address := range cm.nodeAddr {
+			if address == args.Address {
+				nodeId = id
+			}
+		}
+	}
+	if nodeId == 0 {
+		nodeId = 1
+		for id := range cm.nodeAddr {
+			if id >= nodeId {
+				nodeId = id + 1
+			}
+		}
+	}
+	changed := cm.nodeAddr[nodeId] != args.Address
+	if changed {
+		cm.nodeAddr[nodeId] = args.Address
+		cm.membersVersion++
+		if err := cm.logMembers(); err != nil {
+			cm.lock.Unlock()
+			return err
+		}
+	}
+	members, version := cm.members()
+	cm.lock.Unlock()
+
+	res.NodeId = nodeId
+	res.Members = members
+	res.MembersVersion = version
+	if changed {
+		cm.log().Info("Node joined", "member", nodeId, "address", args.Address, "clock", clock)
+		return cm.membershipChanged(members, version, nodeId)
+	}
+	return nil
+}
+
+// Leave rpc called by a node that wants to leave the cluster. It is refused while the node owns
+// pages or has a request in progress. The node is taken out of every copy set, it drops its copies
+func (cm *CentralManager) Leave(args *LeaveArgs, res *LeaveResponse) error {
+	if err := cm.checkPrimary(); err != nil {
+		return err
+	}
+	clock := cm.clock.witness(args.Clock)
+	defer func() { res.Clock = cm.clock.tick() }()
+
+	cm.lock.RLock()
+	_, isMember := cm.nodeAddr[args.NodeId]
+	records := append([]*PageRecord{}, cm.PageRecords...)
+	cm.lock.RUnlock()
+	if !isMember {
+		return fmt.Errorf("node %d is not a member", args.NodeId)
+	}
+
+	owned := []int{}
+	busy := false
+	for _, pr := range records {
+		pr.lock.Lock()
+		if pr.Owner == args.NodeId {
+			owned = append(owned, pr.PageNum)
+		}
+		if pr.hasRequestFrom(args.NodeId) {
+			busy = true
+		}
+		pr.lock.Unlock()
+	}
+	if len(owned) > 0 {
+		return fmt.Errorf("node %d still owns pages %v", args.NodeId, owned)
+	}
+	if busy {
+		return errors.New("node has a request in progress")
+	}
+
+	for _, pr := range records {
+		pr.lock.Lock()
+		if !containsNode(pr.CopySet, args.NodeId) {
+			pr.lock.Unlock()
+			continue
+		}
+		copySet := []int{}
+		for _, nodeId := range pr.CopySet {
+			if nodeId != args.NodeId {
+				copySet = append(copySet, nodeId)
+			}
+		}
+		pr.CopySet = copySet
+		state, err := cm.snapshot(pr)
+		pr.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := cm.replicate(state); err != nil {
+			return err
+		}
+	}
+
+	cm.lock.Lock()
+	delete(cm.nodeAddr, args.NodeId)
+	cm.membersVersion++
+	if err := cm.logMembers(); err != nil {
+		cm.lock.Unlock()
+		return err
+	}
+	members, version := cm.members()
+	cm.lock.Unlock()
+
+	cm.log().Info("Node left", "member", args.NodeId, "clock", clock)
+	return cm.membershipChanged(members, version, args.NodeId)
+}
+
+// nodeAddress returns the address of another node, as last heard from the CM
+func (node *Node) nodeAddress(nodeId int) string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	return node.Nodeaddr[nodeId]
+}
+
+// nodeAddrs returns a copy of the node's view of the membership
+func (node *Node) nodeAddrs() map[int]string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	members := map[int]string{}
+	for id, address := range node.Nodeaddr {
+		members[id] = address
+	}
+	return members
+}
+
+// setMembers replaces the node's view of the membership if the new one is newer
+func (node *Node) setMembers(members map[int]string, version int) {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if version <= node.membersVersion {
+		return
+	}
+	node.Nodeaddr = members
+	node.membersVersion = version
+}
+
+// UpdateMembership is a RPC method that is called by the CM whenever a node joins or leaves
+func (node *Node) UpdateMembership(args *MembershipArgs, res *MembershipResponse) error {
+	clock := node.clock.witness(args.Clock)
+	node.log().Info("Got membership", "version", args.MembersVersion, "members", len(args.Members), "clock", clock)
+	node.setMembers(args.Members, args.MembersVersion)
+	res.Clock = node.clock.tick()
+	return nil
+}
+
+// Join registers the node with the CM under address and fetches the addresses of the other
+// nodes. A node created with id 0 takes the id the CM gives it, so Join must be called before Start
+func (node *Node) Join(address string) error {
+	if node.managers != nil || node.ownership != nil {
+		return errFixedMembership
+	}
+	req := &JoinArgs{NodeId: node.Id, Address: address, Clock: node.clock.tick()}
+	res := &JoinResponse{}
+
+	err := node.callCM("CentralManager.Join", req, res)
+	if err != nil {
+		return err
+	}
+	clock := node.clock.witness(res.Clock)
+
+	node.Id = res.NodeId
+	node.setMembers(res.Members, res.MembersVersion)
+	node.log().Info("Joined the cluster", "address", address, "clock", clock)
+	return nil
+}
+
+// Leave deregisters the node from the CM and drops its cached copies. It fails if the node
+// still owns pages
+func (node *Node) Leave() error {
+	if node.managers != nil || node.ownership != nil {
+		return errFixedMembership
+	}
+	req := &LeaveArgs{NodeId: node.Id, Clock: node.clock.tick()}
+	res := &LeaveResponse{}
+
+	err := node.callCM("CentralManager.Leave", req, res)
+	if err != nil {
+		return err
+	}
+	clock := node.clock.witness(res.Clock)
+
+	node.lock.Lock()
+	node.Pages = []*Page{}
+	node.lock.Unlock()
+	node.log().Info("Left the cluster", "clock", clock)
+	return nil
+}
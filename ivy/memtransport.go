@@ -0,0 +1,167 @@
+package ivy
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemTransport is a Transport that delivers calls over channels between endpoints in the same
+// process, so that a CM and several nodes can run inside one test without opening any ports.
+// Arguments and replies are copied with gob on the way, as they would be on the wire
+type MemTransport struct {
+	lock      sync.Mutex
+	endpoints map[string]*memEndpoint
+}
+
+type memEndpoint struct {
+	services map[string]any
+	inbox    chan *memCall
+	quit     chan struct{}
+}
+
+type memCall struct {
+	method string
+	args   []byte
+	done   chan memResult
+}
+
+type memResult struct {
+	reply []byte
+	err   error
+}
+
+func NewMemTransport() *MemTransport {
+	return &MemTransport{endpoints: map[string]*memEndpoint{}}
+}
+
+func (transport *MemTransport) Serve(address string, services map[string]any) (io.Closer, error) {
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+
+	if transport.endpoints[address] != nil {
+		return nil, fmt.Errorf("address %s already in use", address)
+	}
+	endpoint := &memEndpoint{services: services, inbox: make(chan *memCall), quit: make(chan struct{})}
+	transport.endpoints[address] = endpoint
+	go endpoint.loop()
+
+	return &memListener{transport: transport, address: address, endpoint: endpoint}, nil
+}
+
+func (transport *MemTransport) Call(address string, method string, args any, reply any, timeout time.Duration) error {
+	transport.lock.Lock()
+	endpoint := transport.endpoints[address]
+	transport.lock.Unlock()
+	if endpoint == nil {
+		return fmt.Errorf("no endpoint listening on %s", address)
+	}
+
+	encodedArgs, err := gobEncode(args)
+	if err != nil {
+		return err
+	}
+	call := &memCall{method: method, args: encodedArgs, done: make(chan memResult, 1)}
+
+	select {
+	case endpoint.inbox <- call:
+	case <-endpoint.quit:
+		return fmt.Errorf("endpoint %s closed", address)
+	}
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+	select {
+	case result := <-call.done:
+		if result.err != nil {
+			return result.err
+		}
+		return gobDecode(result.reply, reply)
+	case <-timer:
+		return errors.New("timed out")
+	}
+}
+
+func (endpoint *memEndpoint) loop() {
+	for {
+		select {
+		case call := <-endpoint.inbox:
+			// calls are handled concurrently, like net/rpc does for calls on one connection
+			go func() {
+				call.done <- endpoint.dispatch(call)
+			}()
+		case <-endpoint.quit:
+			return
+		}
+	}
+}
+
+// dispatch calls the method named by call.method the same way net/rpc would
+func (endpoint *memEndpoint) dispatch(call *memCall) memResult {
+	dot := strings.LastIndex(call.method, ".")
+	if dot < 0 {
+		return memResult{err: rpc.ServerError("rpc: service/method request ill-formed: " + call.method)}
+	}
+	service := endpoint.services[call.method[:dot]]
+	if service == nil {
+		return memResult{err: rpc.ServerError("rpc: can't find service " + call.method)}
+	}
+	method := reflect.ValueOf(service).MethodByName(call.method[dot+1:])
+	if !method.IsValid() || method.Type().NumIn() != 2 || method.Type().NumOut() != 1 {
+		return memResult{err: rpc.ServerError("rpc: can't find method " + call.method)}
+	}
+
+	args := reflect.New(method.Type().In(0).Elem())
+	err := gobDecode(call.args, args.Interface())
+	if err != nil {
+		return memResult{err: err}
+	}
+	reply := reflect.New(method.Type().In(1).Elem())
+
+	out := method.Call([]reflect.Value{args, reply})
+	if err, _ := out[0].Interface().(error); err != nil {
+		return memResult{err: rpc.ServerError(err.Error())}
+	}
+
+	encodedReply, err := gobEncode(reply.Interface())
+	return memResult{reply: encodedReply, err: err}
+}
+
+type memListener struct {
+	transport *MemTransport
+	address   string
+	endpoint  *memEndpoint
+	closeOnce sync.Once
+}
+
+// Close stops accepting calls on the address, calls already being handled still complete
+func (listener *memListener) Close() error {
+	listener.closeOnce.Do(func() {
+		listener.transport.lock.Lock()
+		if listener.transport.endpoints[listener.address] == listener.endpoint {
+			delete(listener.transport.endpoints, listener.address)
+		}
+		listener.transport.lock.Unlock()
+		close(listener.endpoint.quit)
+	})
+	return nil
+}
+
+func gobEncode(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(value)
+	return buf.Bytes(), err
+}
+
+func gobDecode(data []byte, value any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
@@ -0,0 +1,408 @@
+package ivy
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// the protocol logs every message, only the failures are of interest here
+	SetLogLevel("error")
+	os.Exit(m.Run())
+}
+
+// testCluster is a CM and some nodes on a MemTransport. Page p starts out owned by node
+// 1 + (p-1) % nodes with the content "page p"
+type testCluster struct {
+	cm    *CentralManager
+	nodes map[int]*Node
+}
+
+func startCluster(t *testing.T, numNodes int, numPages int, policy string) *testCluster {
+	t.Helper()
+	transport := NewMemTransport()
+	nodeAddr := map[int]string{}
+	for i := 1; i <= numNodes; i++ {
+		nodeAddr[i] = "node" + strconv.Itoa(i)
+	}
+	CMaddr := map[int]string{0: "cm0"}
+
+	pageRecords := []*PageRecord{}
+	nodePages := map[int][]*Page{}
+	for p := 1; p <= numPages; p++ {
+		owner := 1 + (p-1)%numNodes
+		pageRecords = append(pageRecords, &PageRecord{PageNum: p, CopySet: []int{}, Owner: owner, Policy: policy})
+		nodePages[owner] = append(nodePages[owner], &Page{PageNum: p, Content: "page " + strconv.Itoa(p), Access: WRITE})
+	}
+
+	cluster := &testCluster{cm: NewCentralManager(0, 0, nodeAddr, pageRecords, CMaddr, 0, transport), nodes: map[int]*Node{}}
+	if err := cluster.cm.Start(false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.cm.Close() })
+	for i := 1; i <= numNodes; i++ {
+		node := NewNode(i, 0, CMaddr, nodeAddr, nodePages[i], transport)
+		if err := node.Start(nodeAddr[i]); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+		cluster.nodes[i] = node
+	}
+	return cluster
+}
+
+// testStep is one operation of a cluster test. A read expects want, a write writes want
+type testStep struct {
+	nodeId  int
+	kind    string // "read", "write", "alloc" or "free"
+	pageNum int
+	want    string
+	fails   bool
+}
+
+func (cluster *testCluster) run(t *testing.T, steps []testStep) {
+	t.Helper()
+	for i, step := range steps {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		node := cluster.nodes[step.nodeId]
+		var err error
+		switch step.kind {
+		case "read":
+			var content []byte
+			content, err = node.ReadPage(ctx, step.pageNum)
+			if err == nil && string(content) != step.want {
+				t.Fatalf("step %d: node %d read %q from page %d, want %q", i, step.nodeId, content, step.pageNum, step.want)
+			}
+		case "write":
+			err = node.WritePage(ctx, step.pageNum, []byte(step.want))
+		case "alloc":
+			var pageNum int
+			pageNum, err = node.AllocatePage(step.want)
+			if err == nil && pageNum != step.pageNum {
+				t.Fatalf("step %d: node %d allocated page %d, want %d", i, step.nodeId, pageNum, step.pageNum)
+			}
+		case "free":
+			err = node.FreePage(step.pageNum)
+		}
+		cancel()
+		if step.fails && err == nil {
+			t.Fatalf("step %d: node %d %s of page %d succeeded, want an error", i, step.nodeId, step.kind, step.pageNum)
+		}
+		if !step.fails && err != nil {
+			t.Fatalf("step %d: node %d %s of page %d: %v", i, step.nodeId, step.kind, step.pageNum, err)
+		}
+	}
+}
+
+func TestMemCluster(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		steps  []testStep
+	}{
+		{
+			name: "read fetches a copy from the owner",
+			steps: []testStep{
+				{nodeId: 2, kind: "read", pageNum: 1, want: "page 1"},
+				{nodeId: 3, kind: "read", pageNum: 1, want: "page 1"},
+				{nodeId: 1, kind: "read", pageNum: 1, want: "page 1"},
+			},
+		},
+		{
+			name: "write invalidates the copies",
+			steps: []testStep{
+				{nodeId: 2, kind: "read", pageNum: 1, want: "page 1"},
+				{nodeId: 3, kind: "read", pageNum: 1, want: "page 1"},
+				{nodeId: 3, kind: "write", pageNum: 1, want: "x"},
+				{nodeId: 2, kind: "read", pageNum: 1, want: "x"},
+				{nodeId: 1, kind: "read", pageNum: 1, want: "x"},
+				{nodeId: 1, kind: "write", pageNum: 1, want: "y"},
+				{nodeId: 3, kind: "read", pageNum: 1, want: "y"},
+			},
+		},
+		{
+			name:   "update pushes writes to the copies",
+			policy: PolicyUpdate,
+			steps: []testStep{
+				{nodeId: 2, kind: "read", pageNum: 1, want: "page 1"},
+				{nodeId: 3, kind: "read", pageNum: 1, want: "page 1"},
+				{nodeId: 2, kind: "write", pageNum: 1, want: "x"},
+				{nodeId: 3, kind: "read", pageNum: 1, want: "x"},
+				{nodeId: 1, kind: "read", pageNum: 1, want: "x"},
+				{nodeId: 3, kind: "write", pageNum: 1, want: "y"},
+				{nodeId: 2, kind: "read", pageNum: 1, want: "y"},
+			},
+		},
+		{
+			name: "allocated page can be shared and freed",
+			steps: []testStep{
+				{nodeId: 1, kind: "alloc", pageNum: 4},
+				{nodeId: 1, kind: "write", pageNum: 4, want: "new"},
+				{nodeId: 2, kind: "read", pageNum: 4, want: "new"},
+				{nodeId: 3, kind: "free", pageNum: 4},
+				{nodeId: 2, kind: "read", pageNum: 4, fails: true},
+				{nodeId: 3, kind: "free", pageNum: 4, fails: true},
+			},
+		},
+		{
+			name: "unknown policy is refused",
+			steps: []testStep{
+				{nodeId: 1, kind: "alloc", want: "sometimes", fails: true},
+				{nodeId: 1, kind: "alloc", pageNum: 4, want: PolicyUpdate},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			startCluster(t, 3, 3, test.policy).run(t, test.steps)
+		})
+	}
+}
+
+// a free sent again while the first copy is being served gets the result of the first copy
+func TestMemFreeSentAgain(t *testing.T) {
+	cluster := startCluster(t, 3, 3, "")
+	cluster.run(t, []testStep{
+		{nodeId: 2, kind: "read", pageNum: 1, want: "page 1"},
+		{nodeId: 3, kind: "read", pageNum: 1, want: "page 1"},
+	})
+
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			args := &FreePageArgs{PageNum: 1, RequesterId: 2, RequestId: "2-free"}
+			errs[i] = cluster.cm.FreePage(args, &FreePageResponse{})
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("copy %d of the free: %v", i, err)
+		}
+	}
+	if cluster.cm.findPageRecord(1) != nil {
+		t.Fatal("page 1 is still on record after the free")
+	}
+	// and once more after the free is done
+	if err := cluster.cm.FreePage(&FreePageArgs{PageNum: 1, RequesterId: 2, RequestId: "2-free"}, &FreePageResponse{}); err != nil {
+		t.Fatalf("free sent again after it was served: %v", err)
+	}
+}
+
+// an allocation sent again gets the same page, and the page is not read before its owner has it
+func TestMemAllocateSentAgain(t *testing.T) {
+	cluster := startCluster(t, 3, 1, "")
+	args := &AllocatePageArgs{RequesterId: 1, RequestId: "1-alloc"}
+	for i := range 2 {
+		res := &AllocatePageResponse{}
+		if err := cluster.cm.AllocatePage(args, res); err != nil {
+			t.Fatalf("copy %d of the allocation: %v", i, err)
+		}
+		if res.PageNum != 2 {
+			t.Fatalf("copy %d of the allocation got page %d, want 2", i, res.PageNum)
+		}
+	}
+
+	read := make(chan string, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		content, err := cluster.nodes[2].ReadPage(ctx, 2)
+		if err != nil {
+			content = []byte(err.Error())
+		}
+		read <- string(content)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case content := <-read:
+		t.Fatalf("node 2 read %q from page 2 before node 1 installed it", content)
+	default:
+	}
+
+	node := cluster.nodes[1]
+	node.lock.Lock()
+	node.persist(node.installPage(2, "", WRITE))
+	node.lock.Unlock()
+	if err := node.sendWriteConfirmation(&Request{Id: "1-alloc", PageNum: 2, RequesterId: 1, TypeOfReq: ALLOCATE}); err != nil {
+		t.Fatal(err)
+	}
+	if content := <-read; content != "" {
+		t.Fatalf("node 2 read %q from page 2, want an empty page", content)
+	}
+	// and once more after the allocation is done
+	res := &AllocatePageResponse{}
+	if err := cluster.cm.AllocatePage(args, res); err != nil || res.PageNum != 2 {
+		t.Fatalf("allocation sent again after it was confirmed got page %d: %v", res.PageNum, err)
+	}
+}
+
+// of two CMs acting as primary, the one of the earlier epoch steps down once it hears from the other
+func TestMemPrimaryStepsDown(t *testing.T) {
+	transport := NewMemTransport()
+	nodeAddr := map[int]string{1: "node1"}
+	CMaddr := map[int]string{0: "cm0", 1: "cm1"}
+	cms := []*CentralManager{}
+	for id := range 2 {
+		pageRecords := []*PageRecord{{PageNum: 1, CopySet: []int{}, Owner: 1}}
+		cm := NewCentralManager(id, 0, nodeAddr, pageRecords, CMaddr, 0, transport)
+		if err := cm.Start(false); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cm.Close() })
+		cms = append(cms, cm)
+	}
+	if cms[0].checkPrimary() != nil || cms[1].checkPrimary() == nil {
+		t.Fatal("CM 0 should start as the primary and CM 1 as its backup")
+	}
+
+	// CM 1 wrongly takes over while CM 0 is still running
+	cms[1].takeOver(0)
+	time.Sleep(3 * heartbeatInterval)
+	if cms[0].checkPrimary() == nil {
+		t.Fatal("CM 0 is still primary after CM 1 took over in a later epoch")
+	}
+	if cms[1].checkPrimary() != nil {
+		t.Fatal("CM 1 stepped down")
+	}
+}
+
+// a primary steps down once a backup that followed it goes silent, a backup that takes over from
+// a failed primary keeps serving on its own
+func TestMemLease(t *testing.T) {
+	tests := []struct {
+		name        string
+		stop        int // the CM that stops
+		wait        time.Duration
+		wantPrimary bool // whether the other CM is primary after wait
+	}{
+		{name: "backup stops", stop: 1, wait: failoverTimeout},
+		{name: "primary stops", stop: 0, wait: failoverTimeout + 2*leaseTimeout, wantPrimary: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transport := NewMemTransport()
+			nodeAddr := map[int]string{1: "node1"}
+			CMaddr := map[int]string{0: "cm0", 1: "cm1"}
+			cms := []*CentralManager{}
+			for id := range 2 {
+				pageRecords := []*PageRecord{{PageNum: 1, CopySet: []int{}, Owner: 1}}
+				cm := NewCentralManager(id, 0, nodeAddr, pageRecords, CMaddr, 0, transport)
+				if err := cm.Start(false); err != nil {
+					t.Fatal(err)
+				}
+				cms = append(cms, cm)
+			}
+			// the backup acknowledges a few heartbeats before one of the CMs stops
+			time.Sleep(3 * heartbeatInterval)
+			cms[test.stop].Close()
+			running := cms[1-test.stop]
+			t.Cleanup(func() { running.Close() })
+
+			time.Sleep(test.wait)
+			if isPrimary := running.checkPrimary() == nil; isPrimary != test.wantPrimary {
+				t.Fatalf("CM %d is primary: %v, want %v", running.Id, isPrimary, test.wantPrimary)
+			}
+		})
+	}
+}
+
+// a CM that syncs with the primary comes back after a restart with the primary's pages and not
+// with the newer versions it had of them itself
+func TestMemResyncIsLogged(t *testing.T) {
+	transport := NewMemTransport()
+	nodeAddr := map[int]string{1: "node1", 2: "node2", 3: "node3"}
+	CMaddr := map[int]string{0: "cm0", 1: "cm1"}
+	dir := t.TempDir()
+	cms := []*CentralManager{}
+	for id := range 2 {
+		pageRecords := []*PageRecord{{PageNum: 1, CopySet: []int{}, Owner: 1}}
+		cm := NewCentralManager(id, 0, nodeAddr, pageRecords, CMaddr, 0, transport)
+		if id == 1 {
+			if err := cm.OpenWAL(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := cm.Start(false); err != nil {
+			t.Fatal(err)
+		}
+		cms = append(cms, cm)
+	}
+	t.Cleanup(func() { cms[0].Close() })
+
+	// the primary hands page 1 to node 3 once, CM 1 hands it to node 2 several times
+	setOwner := func(cm *CentralManager, owner int, times int) {
+		pr := cm.findPageRecord(1)
+		pr.lock.Lock()
+		defer pr.lock.Unlock()
+		pr.Owner = owner
+		for range times {
+			if _, err := cm.snapshot(pr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	setOwner(cms[0], 3, 1)
+	setOwner(cms[1], 2, 5)
+
+	cms[1].resync(0)
+	if owner := cms[1].findPageRecord(1).Owner; owner != 3 {
+		t.Fatalf("page 1 is owned by node %d after the sync, want 3", owner)
+	}
+	cms[1].Close()
+
+	wal, _, err := OpenWAL(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	records := wal.State().Records
+	if len(records) != 1 || records[0].Owner != 3 {
+		t.Fatalf("the log has %+v after the sync, want page 1 owned by node 3", records)
+	}
+}
+
+// a copy is not read while an update of it is prepared, until the update is aborted or applied. An
+// update that arrives late does not go over a newer one
+func TestMemUpdatePrepared(t *testing.T) {
+	cluster := startCluster(t, 3, 1, PolicyUpdate)
+	cluster.run(t, []testStep{{nodeId: 2, kind: "read", pageNum: 1, want: "page 1"}})
+	node := cluster.nodes[2]
+
+	tests := []struct {
+		name        string
+		update      UpdatePageArgs
+		wantContent string
+		wantAccess  int
+	}{
+		{name: "prepare", update: UpdatePageArgs{Seq: 1, Content: "x", Prepare: true}, wantContent: "page 1", wantAccess: updating},
+		{name: "abort", update: UpdatePageArgs{Seq: 1, Abort: true}, wantContent: "page 1", wantAccess: READ},
+		{name: "prepare the next", update: UpdatePageArgs{Seq: 2, Content: "y", Prepare: true}, wantContent: "page 1", wantAccess: updating},
+		{name: "apply", update: UpdatePageArgs{Seq: 2, Content: "y"}, wantContent: "y", wantAccess: READ},
+		{name: "late update", update: UpdatePageArgs{Seq: 1, Content: "x"}, wantContent: "y", wantAccess: READ},
+	}
+	for _, test := range tests {
+		update := test.update
+		update.PageNum = 1
+		update.OwnerId = 1
+		update.RequesterId = 3
+		update.RequestId = "3-" + strconv.Itoa(update.Seq)
+		if err := node.UpdatePage(&update, &UpdatePageResponse{}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		node.lock.Lock()
+		page := node.findPage(1)
+		content, access := page.Content, page.Access
+		node.lock.Unlock()
+		if content != test.wantContent || access != test.wantAccess {
+			t.Fatalf("%s: node 2 has %q with access %d, want %q with access %d", test.name, content, access, test.wantContent, test.wantAccess)
+		}
+	}
+}
@@ -1,13 +1,21 @@
 package ivy
 
+import "time"
+
 type Request struct {
+	Id          string // created by the requesting node and carried in every message about the request
 	PageNum     int
 	RequesterId int
 	Clock       int
 	TypeOfReq   int
 	Content     string
+	done        chan error // signalled on the requesting node once the request is confirmed
+	queuedAt    time.Time  // when the CM queued the request, zero for requests replicated from another CM
 }
 
+// every message about a node's read, write, allocation or free carries the RequestId of the request,
+// so that the log lines and trace spans of all its hops can be found together
+
 // sent from node to CM
 type RequestMessage struct {
 	PageNum     int
@@ -26,82 +34,283 @@ type ForwardMessage struct { // sent from CM to node
 type ReadRequestArgs struct {
 	PageNum     int
 	RequesterId int
+	RequestId   string
 	Clock       int
 }
 
-// no reply expected
+// no reply expected besides the clock
 type ReadRequestResponse struct {
+	Clock int
 }
 
 type ReadForwardArgs struct {
 	PageNum     int
 	RequesterId int
+	RequestId   string
+	Applied     int // the last update of the page that went through, see Node.settleUpdate
 	Clock       int
 }
 
-// no reply expected
+// no reply expected besides the clock
 type ReadForwardResponse struct {
+	Clock int
 }
 
 type SendPageArgs struct {
-	PageNum int
-	Content string
-	OwnerId int
+	PageNum   int
+	Content   string
+	OwnerId   int
+	RequestId string
+	Clock     int
+	CopySet   []int // under the dynamic distributed manager, the copies a writer has to invalidate
 }
 
-// no reply expected
+// sent from node to node under the dynamic distributed manager, along the probable owner chain
+type OwnerRequestArgs struct {
+	PageNum     int
+	RequesterId int
+	RequestId   string
+	TypeOfReq   int
+	Hops        int // times the request was forwarded
+	Clock       int
+}
+
+type OwnerRequestResponse struct {
+	OwnerId int // the owner of the page if the request got to it, 0 if not
+	Clock   int
+}
+
+// no reply expected besides the clock
 type SendPageResponse struct {
+	Clock int
 }
 
 type ReadConfirmArgs struct {
 	PageNum     int
 	RequesterId int
+	RequestId   string
 	Clock       int
 }
 
 type ReadConfirmResponse struct {
 	Confirm bool
+	Clock   int
 }
 
 type WriteRequestArgs struct {
 	PageNum     int
 	Content     string
 	RequesterId int
+	RequestId   string
 	Clock       int
 }
 
-// no reply expected
+// no reply expected besides the clock
 type WriteRequestResponse struct {
+	Clock int
 }
 
 type InvalidateArgs struct {
-	PageNum int
+	PageNum     int
+	RequesterId int // the node whose request needs the copies gone
+	RequestId   string
+	Clock       int
 }
 
 type InvalidateResponse struct {
-	Ack bool
+	Ack   bool
+	Clock int
 }
 
 type WriteForwardArgs struct {
 	PageNum     int
 	Content     string
 	RequesterId int
+	RequestId   string
+	Applied     int // the last update of the page that went through, see Node.settleUpdate
 	Clock       int
 }
 
-// no reply expected
+// no reply expected besides the clock
 type WriteForwardResponse struct {
+	Clock int
 }
 
 type WriteConfirmArgs struct {
 	PageNum     int
 	RequesterId int
+	RequestId   string
 	Clock       int
 }
 
-// no reply expected
 type WriteConfirmResponse struct {
 	Confirm bool
+	Clock   int
+}
+
+type RequestFailedArgs struct {
+	PageNum   int
+	TypeOfReq int
+	Reason    string
+	RequestId string
+	Clock     int
+}
+
+// no reply expected besides the clock
+type RequestFailedResponse struct {
+	Clock int
+}
+
+// sent from CM to every holder of a copy of a page with the update policy, and last to the writer
+type UpdatePageArgs struct {
+	PageNum     int
+	Content     string
+	Seq         int // the writes of a page are numbered in the order the CM serves them
+	OwnerId     int
+	RequesterId int
+	RequestId   string
+	Reason      string // set for the writer if the update was aborted, its write fails
+	Prepare     bool   // the copy is not read until the update itself or its abort comes
+	Abort       bool   // the update does not go through, the copy is read as it was
+	Clock       int
+}
+
+// no reply expected besides the clock
+type UpdatePageResponse struct {
+	Clock int
+}
+
+type PageInfoArgs struct {
+	PageNum int
+}
+
+type SetPolicyArgs struct {
+	PageNum int
+	Policy  string
+}
+
+// no reply expected
+type SetPolicyResponse struct {
+}
+
+type PageInfoResponse struct {
+	PageNum int
+	Owner   int
+	CopySet []int
+	Waiting int    // requests in flight or queued for the page
+	Policy  string // the page's coherence policy, empty for the default
+}
+
+type AllocatePageArgs struct {
+	RequesterId int
+	RequestId   string
+	Policy      string // coherence policy of the new page, empty for the default
+	Clock       int
+}
+
+type AllocatePageResponse struct {
+	PageNum int
+	Clock   int
+}
+
+type FreePageArgs struct {
+	PageNum     int
+	RequesterId int
+	RequestId   string
+	Clock       int
+}
+
+// no reply expected besides the clock
+type FreePageResponse struct {
+	Clock int
+}
+
+type ListPagesArgs struct {
+}
+
+type ListPagesResponse struct {
+	Pages []PageInfoResponse
+}
+
+type ReplicateArgs struct {
+	PrimaryId      int
+	Epoch          int
+	Records        []PageRecordState
+	Members        map[int]string // nil unless the membership changed
+	MembersVersion int
+	Clock          int
+}
+
+// no reply expected
+type ReplicateResponse struct {
+}
+
+type HeartbeatArgs struct {
+	PrimaryId int
+	Epoch     int
+}
+
+// no reply expected
+type HeartbeatResponse struct {
+}
+
+type StatusArgs struct {
+}
+
+type StatusResponse struct {
+	CMId      int
+	IsPrimary bool
+	PrimaryId int
+	Epoch     int
+}
+
+type SyncArgs struct {
+}
+
+type SyncResponse struct {
+	PrimaryId      int
+	Records        []PageRecordState
+	Members        map[int]string
+	MembersVersion int
+}
+
+type HandOverArgs struct {
+	CMId int // the CM taking over
+}
+
+// NodeId is 0 for a node that wants the CM to pick its id
+type JoinArgs struct {
+	NodeId  int
+	Address string
+	Clock   int
+}
+
+type JoinResponse struct {
+	NodeId         int
+	Members        map[int]string
+	MembersVersion int
+	Clock          int
+}
+
+type LeaveArgs struct {
+	NodeId int
+	Clock  int
+}
+
+// no reply expected besides the clock
+type LeaveResponse struct {
+	Clock int
+}
+
+type MembershipArgs struct {
+	Members        map[int]string
+	MembersVersion int
+	Clock          int
+}
+
+// no reply expected besides the clock
+type MembershipResponse struct {
+	Clock int
 }
 
 //////////////////////////////
@@ -110,3 +319,7 @@ type InvalidateMessageArgs struct {
 	pageNum int
 	nodeId  int
 }
+
+func (args *ReadRequestArgs) setClock(clock int)  { args.Clock = clock }
+func (args *WriteRequestArgs) setClock(clock int) { args.Clock = clock }
+func (args *FreePageArgs) setClock(clock int)     { args.Clock = clock }
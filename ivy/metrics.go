@@ -0,0 +1,266 @@
+package ivy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bucket bounds for latencies in seconds, and for how many nodes a write invalidates
+var (
+	latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	fanOutBuckets  = []float64{0, 1, 2, 4, 8, 16, 32}
+)
+
+type counter struct {
+	value atomic.Int64
+}
+
+func (c *counter) inc() {
+	c.value.Add(1)
+}
+
+// histogram counts observations into buckets, like a Prometheus histogram
+type histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []int64 // counts[i] is the number of observations <= bounds[i] and > bounds[i-1]
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// since observes the seconds elapsed from start to now
+func (h *histogram) since(start time.Time, now time.Time) {
+	h.observe(now.Sub(start).Seconds())
+}
+
+// metricsWriter writes metrics in the Prometheus text format. The first write error is kept and
+// every write after it is skipped
+type metricsWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (mw *metricsWriter) printf(format string, args ...any) {
+	if mw.err != nil {
+		return
+	}
+	_, mw.err = fmt.Fprintf(mw.w, format, args...)
+}
+
+func (mw *metricsWriter) header(name string, kind string, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (mw *metricsWriter) counter(name string, help string, c *counter) {
+	mw.header(name, "counter", help)
+	mw.printf("%s %d\n", name, c.value.Load())
+}
+
+func (mw *metricsWriter) gauge(name string, help string, value float64) {
+	mw.header(name, "gauge", help)
+	mw.printf("%s %s\n", name, formatFloat(value))
+}
+
+func (mw *metricsWriter) histogram(name string, help string, h *histogram) {
+	h.lock.Lock()
+	counts := append([]int64{}, h.counts...)
+	sum := h.sum
+	count := h.count
+	h.lock.Unlock()
+
+	mw.header(name, "histogram", help)
+	var cumulative int64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		mw.printf("%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+	}
+	mw.printf("%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	mw.printf("%s_sum %s\n", name, formatFloat(sum))
+	mw.printf("%s_count %d\n", name, count)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// cmMetrics are the counters and histograms of a CentralManager
+type cmMetrics struct {
+	readRequests        counter
+	writeRequests       counter
+	freeRequests        counter
+	readForwards        counter
+	writeForwards       counter
+	invalidations       counter
+	invalidationsFailed counter
+	droppedRequests     counter
+	updates             counter
+	updatesFailed       counter
+	invalidationsPerOp  *histogram // invalidations sent for each write or free
+	updatesPerOp        *histogram // updates sent for each write under the update policy, the writer's included
+	readSeconds         *histogram // from a read request being queued to its ReadConfirm
+	writeSeconds        *histogram // from a write request being queued to its WriteConfirm
+}
+
+func newCMMetrics() cmMetrics {
+	return cmMetrics{
+		invalidationsPerOp: newHistogram(fanOutBuckets),
+		updatesPerOp:       newHistogram(fanOutBuckets),
+		readSeconds:        newHistogram(latencyBuckets),
+		writeSeconds:       newHistogram(latencyBuckets),
+	}
+}
+
+// WriteMetrics writes the CM's metrics in the Prometheus text format
+func (cm *CentralManager) WriteMetrics(w io.Writer) error {
+	cm.lock.RLock()
+	records := append([]*PageRecord{}, cm.PageRecords...)
+	isPrimary := 0.0
+	if cm.isPrimary {
+		isPrimary = 1
+	}
+	members := len(cm.nodeAddr)
+	cm.lock.RUnlock()
+
+	waiting := 0
+	for _, pr := range records {
+		pr.lock.Lock()
+		waiting += len(pr.queue)
+		if pr.inFlight != nil {
+			waiting++
+		}
+		pr.lock.Unlock()
+	}
+
+	m := &cm.metrics
+	mw := &metricsWriter{w: w}
+	mw.gauge("ivy_cm_primary", "Whether this CM is the primary.", isPrimary)
+	mw.gauge("ivy_cm_pages", "Pages in the page table.", float64(len(records)))
+	mw.gauge("ivy_cm_nodes", "Member nodes.", float64(members))
+	mw.gauge("ivy_cm_queue_depth", "Requests in flight or queued, over all pages.", float64(waiting))
+	mw.counter("ivy_cm_read_requests_total", "Read requests received, the read fault rate.", &m.readRequests)
+	mw.counter("ivy_cm_write_requests_total", "Write requests received, the write fault rate.", &m.writeRequests)
+	mw.counter("ivy_cm_free_requests_total", "Free requests received.", &m.freeRequests)
+	mw.counter("ivy_cm_read_forwards_total", "Read forwards sent to page owners.", &m.readForwards)
+	mw.counter("ivy_cm_write_forwards_total", "Write forwards sent to page owners.", &m.writeForwards)
+	mw.counter("ivy_cm_invalidations_total", "Invalidations sent to nodes.", &m.invalidations)
+	mw.counter("ivy_cm_invalidations_failed_total", "Invalidations that were not acknowledged.", &m.invalidationsFailed)
+	mw.counter("ivy_cm_dropped_requests_total", "Requests dropped because they could not be served.", &m.droppedRequests)
+	mw.counter("ivy_cm_updates_total", "Updates pushed to nodes under the update policy.", &m.updates)
+	mw.counter("ivy_cm_updates_failed_total", "Updates that were not acknowledged.", &m.updatesFailed)
+	mw.histogram("ivy_cm_invalidations_per_write", "Invalidations sent for each write or free.", m.invalidationsPerOp)
+	mw.histogram("ivy_cm_updates_per_write", "Updates sent for each write under the update policy.", m.updatesPerOp)
+	mw.histogram("ivy_cm_read_seconds", "Time from a read request being queued to its confirmation.", m.readSeconds)
+	mw.histogram("ivy_cm_write_seconds", "Time from a write request being queued to its confirmation.", m.writeSeconds)
+	return mw.err
+}
+
+// nodeMetrics are the counters and histograms of a Node. The cache hit ratio for reads is
+// local_reads / (local_reads + read_faults)
+type nodeMetrics struct {
+	localReads        counter
+	readFaults        counter
+	localWrites       counter
+	writeFaults       counter
+	faultsFailed      counter
+	faultRetries      counter
+	readForwards      counter
+	writeForwards     counter
+	ownerForwards     counter // requests passed on along the probable owner chain
+	invalidations     counter
+	updates           counter
+	readFaultSeconds  *histogram // from sending a read request to the CM acknowledging the ReadConfirm
+	writeFaultSeconds *histogram // from sending a write request to the CM acknowledging the WriteConfirm
+}
+
+func newNodeMetrics() nodeMetrics {
+	return nodeMetrics{
+		readFaultSeconds:  newHistogram(latencyBuckets),
+		writeFaultSeconds: newHistogram(latencyBuckets),
+	}
+}
+
+// WriteMetrics writes the node's metrics in the Prometheus text format
+func (node *Node) WriteMetrics(w io.Writer) error {
+	node.lock.Lock()
+	pages := 0
+	owned := 0
+	for _, page := range node.Pages {
+		pages++
+		if page.Access == WRITE {
+			owned++
+		}
+	}
+	node.lock.Unlock()
+
+	m := &node.metrics
+	mw := &metricsWriter{w: w}
+	mw.gauge("ivy_node_pages", "Pages cached on this node.", float64(pages))
+	mw.gauge("ivy_node_writable_pages", "Pages this node holds with write access.", float64(owned))
+	mw.counter("ivy_node_local_reads_total", "Reads served from the cache.", &m.localReads)
+	mw.counter("ivy_node_read_faults_total", "Reads that had to fetch the page.", &m.readFaults)
+	mw.counter("ivy_node_local_writes_total", "Writes applied to a page held with write access.", &m.localWrites)
+	mw.counter("ivy_node_write_faults_total", "Writes that had to fetch the page.", &m.writeFaults)
+	mw.counter("ivy_node_faults_failed_total", "Read and write faults that failed.", &m.faultsFailed)
+	mw.counter("ivy_node_fault_retries_total", "Requests sent to the CM again while waiting for a page.", &m.faultRetries)
+	mw.counter("ivy_node_read_forwards_total", "Read forwards served as the page owner.", &m.readForwards)
+	mw.counter("ivy_node_write_forwards_total", "Write forwards served as the page owner.", &m.writeForwards)
+	mw.counter("ivy_node_owner_forwards_total", "Requests forwarded to the probable owner of a page.", &m.ownerForwards)
+	mw.counter("ivy_node_invalidations_total", "Invalidations received.", &m.invalidations)
+	mw.counter("ivy_node_updates_total", "Updates received under the update policy.", &m.updates)
+	mw.histogram("ivy_node_read_fault_seconds", "Time from a read request to its confirmation.", m.readFaultSeconds)
+	mw.histogram("ivy_node_write_fault_seconds", "Time from a write request to its confirmation.", m.writeFaultSeconds)
+	if mw.err == nil && node.manager != nil {
+		// the pages this node manages
+		return node.manager.WriteMetrics(w)
+	}
+	return mw.err
+}
+
+// ServeMetrics serves GET /metrics on address over HTTP, with the body written by write
+func ServeMetrics(address string, write func(w io.Writer) error) (io.Closer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := write(w); err != nil {
+			logger.Error("Error writing metrics", "err", err)
+		}
+	})
+	server := &http.Server{Handler: mux}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Error serving metrics", "address", address, "err", err)
+		}
+	}()
+	return server, nil
+}
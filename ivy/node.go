@@ -1,20 +1,68 @@
 package ivy
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"net"
+	"io"
 	"net/rpc"
-	"strings"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 )
 
+const (
+	replTimeout     = 10 * time.Second // how long the REPL waits for a page fault to complete
+	retryInterval   = 3 * time.Second  // how long a node waits for a page before sending its request again
+	cmCallTimeout   = 5 * time.Second
+	sendPageTimeout = 2 * time.Second // how long an owner waits for the requester to take a page
+	cmRetryDelay    = 500 * time.Millisecond
+	cmRetryRounds   = 5 // how many times a node goes through every CM before giving up on a call
+	abandonRounds   = 3 // retry intervals a cancelled request may still take before the node gives up on it
+	installedKept   = 8 // request ids a node remembers as installed or given up, to tell a page sent again from a late one
+)
+
+// access of a page that this node owns while it is on its way to a writer. The page is kept, and
+// stays in the store, until the writer has it, but it cannot be read or written here
+const handingOver = -1
+
+// access of a copy that has prepared an update under the update policy. It is not read until the
+// update or its abort comes, see UpdatePage
+const updating = -2
+
 type Node struct {
 	Id             int
 	Pages          []*Page
 	currentCM      int
 	CMaddr         map[int]string
 	Nodeaddr       map[int]string
+	membersVersion int
 	currentRequest *Request
+	requestSeq     int           // numbers the requests of this node, see newRequestId
+	installed      []string      // ids of the last installedKept requests whose page arrived, see handleSendPage
+	abandoned      []string      // ids of the last installedKept requests given up on before their page arrived
+	lock           sync.Mutex    // protects Pages, Nodeaddr, currentRequest, requestSeq, installed and abandoned
+	faultSlot      chan struct{} // only one outstanding request to the CM at a time
+	cmLock         sync.Mutex    // protects currentCM
+	clock          lamportClock
+	transport      Transport
+	listener       io.Closer
+	store          *PageStore // keeps the pages this node owns on disk if set, see OpenStore
+	metrics        nodeMetrics
+	tracer         *Tracer                 // records a span for every hop this node handles if set, see OpenTrace
+	history        *History                // records every ReadPage and WritePage if set, see RecordHistory
+	updateSeq      map[int]int             // number of the last update applied to each page, see UpdatePage. Protected by lock
+	prepared       map[int]*UpdatePageArgs // the update each page has prepared and not yet applied or dropped. Protected by lock
+	handedOver     map[int]string          // id of the last write each page was handed over for, see WriteForward. Protected by lock
+
+	// set if the nodes manage the pages instead of the CMs, see ManagePages
+	managers []int           // ids of every node, page p is managed by managers[p % len(managers)]
+	manager  *CentralManager // the page records of the pages this node manages
+
+	// set if the nodes find the owners through probable owner chains, see ManageDynamically
+	allocators []int              // ids of every node, page p is allocated by allocators[p % len(allocators)]
+	ownership  map[int]*ownership // protected by lock
 }
 
 type Page struct {
@@ -23,50 +71,254 @@ type Page struct {
 	Access  int
 }
 
-func (node *Node) ReadRequestFromCM(pageNum int) error {
-	// make an RPC call to the CM to get the page
-	address := strings.TrimSpace(node.CMaddr[node.currentCM])
-	client, err := rpc.Dial("tcp", address)
-	if err != nil {
-		fmt.Println("Error connecting to CM", err)
-		return err
+// callCM makes an RPC call to the current CM. If the CM cannot be reached or is no longer the
+// primary, the node switches to the next CM in CMaddr and tries the call again
+func (node *Node) callCM(method string, args any, reply any) error {
+	var err error
+	for attempt := 0; attempt < cmRetryRounds*len(node.CMaddr); attempt++ {
+		node.cmLock.Lock()
+		cmId := node.currentCM
+		node.cmLock.Unlock()
+
+		if attempt > 0 {
+			node.restamp(args)
+		}
+		err = node.transport.Call(node.CMaddr[cmId], method, args, reply, cmCallTimeout)
+		if err == nil {
+			return nil
+		}
+		if serverErr, ok := err.(rpc.ServerError); ok && string(serverErr) != errNotPrimary.Error() {
+			// the CM is up and refused the call
+			return err
+		}
+
+		nextId := node.switchCM(cmId)
+		node.log().Warn("CM unavailable, switching", "cm", cmId, "next", nextId, "err", err)
+		<-after(node.transport, cmRetryDelay)
 	}
-	defer client.Close()
+	return err
+}
 
-	req := &ReadRequestArgs{PageNum: pageNum, RequesterId: node.Id, Clock: 0}
-	res := &ReadRequestResponse{}
+// queued is implemented by the requests that a CM queues by their clock
+type queued interface {
+	setClock(clock int)
+}
+
+// restamp gives a request that is sent again a new clock, so that the CM queues it by when it
+// arrives and not ahead of the requests sent since
+func (node *Node) restamp(args any) {
+	if request, ok := args.(queued); ok {
+		request.setClock(node.clock.tick())
+	}
+}
+
+// switchCM moves currentCM on from a CM that failed, unless another call already did
+func (node *Node) switchCM(failedId int) int {
+	node.cmLock.Lock()
+	defer node.cmLock.Unlock()
+
+	if node.currentCM != failedId {
+		return node.currentCM
+	}
+	ids := []int{}
+	for id := range node.CMaddr {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for i, id := range ids {
+		if id == failedId {
+			node.currentCM = ids[(i+1)%len(ids)]
+			break
+		}
+	}
+	return node.currentCM
+}
+
+// newRequestId returns an id for a new request of this node, unique among the node's requests
+func (node *Node) newRequestId() string {
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	node.requestSeq++
+	return fmt.Sprintf("%d-%d", node.Id, node.requestSeq)
+}
 
-	node.currentRequest = &Request{PageNum: pageNum, RequesterId: node.Id, Clock: 0, TypeOfReq: READ}
+func (node *Node) ReadRequestFromCM(request *Request) error {
+	// a request sent again keeps its id
+	if request.Id == "" {
+		request.Id = node.newRequestId()
+	}
+	defer node.span("ReadRequest", request.Id, request.PageNum, node.Id)()
+
+	// make an RPC call to the CM to get the page
+	req := &ReadRequestArgs{PageNum: request.PageNum, RequesterId: node.Id, RequestId: request.Id, Clock: node.clock.tick()}
+	res := &ReadRequestResponse{}
 
-	err = client.Call("CentralManager.ReadRequest", req, res)
+	node.log().Info("Sending read request", "page", request.PageNum, "request", request.Id, "clock", req.Clock)
+	err := node.callManager(request.PageNum, "CentralManager.ReadRequest", req, res)
 	if err != nil {
-		fmt.Println("Error calling ReadRequest: ", err)
+		node.log().Error("Error calling ReadRequest", "page", request.PageNum, "request", request.Id, "err", err)
 		return err
 	}
+	node.clock.witness(res.Clock)
 
 	return nil
 }
 
 func (node *Node) readFrom(pageNum int) (bool, string) {
 	// if page is in cache, return it
-	// if page is not in cache, send a read request to CM
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
 	for _, page := range node.Pages {
 		if page.PageNum == pageNum && (page.Access == READ || page.Access == WRITE) {
 			return true, page.Content
 		}
 	}
+	return false, ""
+}
+
+// ReadPage returns the content of a page. If the page is not in cache it is requested from the CM,
+// and ReadPage blocks until the page has arrived and the CM has acknowledged the read confirmation.
+func (node *Node) ReadPage(ctx context.Context, pageNum int) ([]byte, error) {
+	invoke := now(node.transport)
+	content, err := node.readPage(ctx, pageNum)
+	node.recordOp("read", pageNum, string(content), invoke, err)
+	return content, err
+}
+
+func (node *Node) readPage(ctx context.Context, pageNum int) ([]byte, error) {
+	if isLocalRead, content := node.readFrom(pageNum); isLocalRead {
+		node.metrics.localReads.inc()
+		return []byte(content), nil
+	}
 
-	error := node.ReadRequestFromCM(pageNum)
-	if error != nil {
-		fmt.Println("Error requesting read from CM: ", error)
-		return false, ""
+	node.metrics.readFaults.inc()
+	start := now(node.transport)
+	request := &Request{PageNum: pageNum, RequesterId: node.Id, TypeOfReq: READ}
+	err := node.fault(ctx, request)
+	if err != nil {
+		node.metrics.faultsFailed.inc()
+		return nil, err
 	}
-	return false, fmt.Sprintln("read request sent to CM for page ", pageNum)
+	node.metrics.readFaultSeconds.since(start, now(node.transport))
+	node.spanSince("ReadFault", request, start)
+	return []byte(request.Content), nil
+}
+
+// fault sends a request to the CM and blocks until the page has been installed and the
+// confirmation has been acknowledged by the CM, or until ctx is done
+func (node *Node) fault(ctx context.Context, request *Request) error {
+	select {
+	case node.faultSlot <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	request.done = make(chan error, 1)
+	node.lock.Lock()
+	node.currentRequest = request
+	node.lock.Unlock()
+
+	err := node.sendRequest(request)
+	if err != nil {
+		node.lock.Lock()
+		node.giveUp(request)
+		node.lock.Unlock()
+		node.endFault(request)
+		return err
+	}
+
+	rounds := 0
+	for {
+		select {
+		case err = <-request.done:
+			node.endFault(request)
+			return err
+		case <-ctx.Done():
+			// the page may still arrive, hold on to the slot for a while so that the next
+			// request does not replace currentRequest under it. After that a late page does
+			// not match the current request and is turned down
+			spawn(node.transport, func() {
+				select {
+				case <-request.done:
+				case <-after(node.transport, abandonRounds*retryInterval):
+					node.lock.Lock()
+					node.giveUp(request)
+					node.lock.Unlock()
+					node.log().Warn("Gave up on cancelled request", "page", request.PageNum, "request", request.Id)
+				}
+				node.endFault(request)
+			})
+			return ctx.Err()
+		case <-after(node.transport, retryInterval):
+			// the CM may have failed over while the request was in flight. Send it again,
+			// a CM that already has the request ignores the copy. A request down the
+			// probable owner chain is not sent again: it is passed on from node to node
+			// until one takes it, and failed with RequestFailed by a node that cannot pass
+			// it on. If the node that has it crashes, the fault gives up after
+			// abandonRounds and a page that arrives later is turned down
+			node.lock.Lock()
+			waiting := node.currentRequest == request && !node.wasInstalled(request.Id)
+			if waiting && node.ownership != nil {
+				rounds++
+				if rounds >= abandonRounds {
+					node.giveUp(request)
+				}
+			}
+			node.lock.Unlock()
+			if waiting && node.ownership != nil {
+				if rounds >= abandonRounds {
+					node.log().Warn("Gave up on request down the probable owner chain", "page", request.PageNum, "request", request.Id)
+					node.endFault(request)
+					return fmt.Errorf("no answer from the owner of page %d", request.PageNum)
+				}
+				continue
+			}
+			if waiting {
+				node.metrics.faultRetries.inc()
+				err = node.sendRequest(request)
+				if _, refused := err.(rpc.ServerError); refused {
+					// the CM already dropped the request and its RequestFailed was lost
+					node.lock.Lock()
+					node.giveUp(request)
+					node.lock.Unlock()
+					node.endFault(request)
+					return err
+				}
+			}
+		}
+	}
+}
+
+// endFault gives up the fault slot once the request is over
+func (node *Node) endFault(request *Request) {
+	if node.ownership != nil {
+		node.doneRequesting(request.PageNum)
+	}
+	spawn(node.transport, func() { <-node.faultSlot })
+}
+
+func (node *Node) sendRequest(request *Request) error {
+	if node.ownership != nil {
+		return node.requestFromOwner(request)
+	}
+	if request.TypeOfReq == READ {
+		return node.ReadRequestFromCM(request)
+	}
+	return node.WriteRequestToCM(request)
 }
 
 // ReadForward is a RPC method that is called by the central manager to forward a read request to the owner of the page
 func (node *Node) ReadForward(args *ReadForwardArgs, res *ReadForwardResponse) error {
+	clock := node.clock.witness(args.Clock)
+	node.log().Info("Received read forward", "page", args.PageNum, "requester", args.RequesterId, "request", args.RequestId, "clock", clock)
+	node.metrics.readForwards.inc()
+	defer node.span("ReadForward", args.RequestId, args.PageNum, args.RequesterId)()
+
 	// get page from local
+	node.lock.Lock()
+	node.settleUpdate(args.PageNum, args.Applied)
 	var requestedPage *Page
 	for _, page := range node.Pages {
 		if page.PageNum == args.PageNum {
@@ -74,251 +326,543 @@ func (node *Node) ReadForward(args *ReadForwardArgs, res *ReadForwardResponse) e
 			break
 		}
 	}
+	if requestedPage == nil {
+		node.lock.Unlock()
+		return fmt.Errorf("node %d does not own page %d", node.Id, args.PageNum)
+	}
 
-	// update access to the page
+	// update access to the page, this node stays the owner
 	requestedPage.Access = READ
-	// check
-	fmt.Println("Updated page record", node.Pages)
+	node.persist(requestedPage)
+	SendPageArgs := &SendPageArgs{PageNum: requestedPage.PageNum, Content: requestedPage.Content, OwnerId: node.Id, RequestId: args.RequestId, Clock: node.clock.tick()}
+	node.lock.Unlock()
 
 	// send the page to the requester
-	address := strings.TrimSpace(node.Nodeaddr[args.RequesterId])
-	client, err := rpc.Dial("tcp", address)
-	if err != nil {
-		fmt.Println("Error connecting to requester")
-		return err
-	}
-	defer client.Close()
-
-	SendPageArgs := &SendPageArgs{requestedPage.PageNum, requestedPage.Content, node.Id}
 	SendPageResponse := &SendPageResponse{}
 
-	err = client.Call("Node.SendPage", SendPageArgs, SendPageResponse)
+	err := node.transport.Call(node.nodeAddress(args.RequesterId), "Node.SendPage", SendPageArgs, SendPageResponse, sendPageTimeout)
 	if err != nil {
-		fmt.Println("Error sending page to requester")
+		node.log().Error("Error sending page to requester", "page", args.PageNum, "requester", args.RequesterId, "err", err)
 		return err
 	}
+	res.Clock = node.clock.witness(SendPageResponse.Clock)
 	return nil
 }
 
 func (node *Node) sendReadConfirmation(request *Request) error {
-	// send a confirmation to the CM
-	address := strings.TrimSpace(node.CMaddr[node.currentCM])
-	client, err := rpc.Dial("tcp", address)
-	if err != nil {
-		fmt.Println("Error connecting to CM", err)
-		return err
-	}
-	defer client.Close()
+	defer node.span("ReadConfirm", request.Id, request.PageNum, node.Id)()
 
-	req := &ReadConfirmArgs{PageNum: request.PageNum, RequesterId: request.RequesterId, Clock: request.Clock}
+	// send a confirmation to the CM
+	req := &ReadConfirmArgs{PageNum: request.PageNum, RequesterId: request.RequesterId, RequestId: request.Id, Clock: node.clock.tick()}
 	res := &ReadConfirmResponse{}
 
-	err = client.Call("CentralManager.ReadConfirm", req, res)
+	err := node.callManager(request.PageNum, "CentralManager.ReadConfirm", req, res)
 	if err != nil {
-		fmt.Println("Error calling ReadConfirm: ", err)
+		node.log().Error("Error calling ReadConfirm", "page", request.PageNum, "err", err)
 		return err
 	}
 
+	clock := node.clock.witness(res.Clock)
+
 	if !res.Confirm {
-		fmt.Println("Read confirmation failed")
+		node.log().Error("Read confirmation failed", "page", request.PageNum)
 		return errors.New("read confirmation failed")
 	}
 
-	fmt.Println("Read confirmed")
+	node.log().Info("Read confirmed", "page", request.PageNum, "request", request.Id, "clock", clock)
 
 	return nil
 }
 
 func (node *Node) sendWriteConfirmation(request *Request) error {
-	// send a confirmation to the CM
-	address := strings.TrimSpace(node.CMaddr[node.currentCM])
-	client, err := rpc.Dial("tcp", address)
-	if err != nil {
-		fmt.Println("Error connecting to CM", err)
-		return err
-	}
-	defer client.Close()
+	defer node.span("WriteConfirm", request.Id, request.PageNum, node.Id)()
 
-	req := &WriteConfirmArgs{PageNum: request.PageNum, RequesterId: request.RequesterId, Clock: request.Clock}
+	// send a confirmation to the CM
+	req := &WriteConfirmArgs{PageNum: request.PageNum, RequesterId: request.RequesterId, RequestId: request.Id, Clock: node.clock.tick()}
 	res := &WriteConfirmResponse{}
 
-	err = client.Call("CentralManager.WriteConfirm", req, res)
+	err := node.callManager(request.PageNum, "CentralManager.WriteConfirm", req, res)
 	if err != nil {
-		fmt.Println("Error calling WriteConfirm: ", err)
+		node.log().Error("Error calling WriteConfirm", "page", request.PageNum, "err", err)
 		return err
 	}
 
+	clock := node.clock.witness(res.Clock)
+
 	if !res.Confirm {
-		logInfo("Write confirmation failed")
+		node.log().Error("Write confirmation failed", "page", request.PageNum)
 		return errors.New("write confirmation failed")
 	}
 
-	logInfo("Write confirmed")
+	node.log().Info("Write confirmed", "page", request.PageNum, "request", request.Id, "clock", clock)
 
 	return nil
 }
 
-func (node *Node) handleSendPage(args *SendPageArgs) error {
-	// check current request matches received page
-	if node.currentRequest.PageNum != args.PageNum {
-		fmt.Println("Received page number ", args.PageNum, " does not match current request ", node.currentRequest.PageNum)
-		return errors.New("Page number does not match current request")
+// wasInstalled reports whether the page for the request with id arrived. A page may be sent again
+// after the next requests, when the owner sends it again after a lost reply. node.lock must be held
+func (node *Node) wasInstalled(id string) bool {
+	for _, installed := range node.installed {
+		if installed == id {
+			return true
+		}
 	}
+	return false
+}
 
-	if node.currentRequest.TypeOfReq == READ {
-		// update the page in the cache
-		newPage := Page{PageNum: args.PageNum, Content: args.Content, Access: READ}
-		node.Pages = append(node.Pages, &newPage)
-
-		// send a confirmation to the CM
-		node.sendReadConfirmation(node.currentRequest)
+// giveUp drops request if it is still the current one and remembers it was given up on, so that
+// a page that arrives for it later is turned down. node.lock must be held
+func (node *Node) giveUp(request *Request) {
+	if node.currentRequest == request {
 		node.currentRequest = nil
+	}
+	node.abandoned = append(node.abandoned, request.Id)
+	if len(node.abandoned) > installedKept {
+		node.abandoned = node.abandoned[1:]
+	}
+}
 
-	} else if node.currentRequest.TypeOfReq == WRITE {
-		found := false
-		// page is already in cache, update the content
-		for _, page := range node.Pages {
-			if page.PageNum == args.PageNum {
-				page.Content = args.Content
-				page.Access = WRITE
-				found = true
-			}
+// wasAbandoned reports whether the node gave up on the request with id. node.lock must be held
+func (node *Node) wasAbandoned(id string) bool {
+	for _, abandoned := range node.abandoned {
+		if abandoned == id {
+			return true
 		}
-		// else, update the page and add it to the cache
-		if !found {
-			newPage := Page{PageNum: args.PageNum, Content: args.Content, Access: WRITE}
-			node.Pages = append(node.Pages, &newPage)
+	}
+	return false
+}
+
+func (node *Node) handleSendPage(args *SendPageArgs) error {
+	clock := node.clock.witness(args.Clock)
+	node.log().Info("Received page", "page", args.PageNum, "owner", args.OwnerId, "request", args.RequestId, "clock", clock)
+
+	node.lock.Lock()
+	request := node.currentRequest
+	if node.wasInstalled(args.RequestId) {
+		// the page was sent again after the reply to the owner was lost
+		node.lock.Unlock()
+		return nil
+	}
+
+	if node.ownership != nil && (request == nil || request.Id != args.RequestId) {
+		if !node.wasAbandoned(args.RequestId) {
+			// installed so long ago that the id is no longer in installed. A page sent for a
+			// request down the probable owner chain is only turned down if the node gave up
+			node.lock.Unlock()
+			return nil
 		}
+		// the sender keeps the page, nodes that pointed at this node for the request it gave up
+		// on get to the sender through here
+		node.pageOwnership(args.PageNum).probOwner = args.OwnerId
+	}
+
+	// check current request matches received page
+	if request == nil {
+		node.lock.Unlock()
+		node.log().Error("Received page but there is no current request", "page", args.PageNum)
+		return errors.New("no current request")
+	}
+	if request.Id != args.RequestId {
+		// a page sent for an earlier request that has failed, it may not even be the same access
+		node.lock.Unlock()
+		node.log().Error("Received page does not match current request", "page", args.PageNum, "request", args.RequestId, "current", request.Id)
+		return errors.New("page does not match current request")
+	}
+	node.installed = append(node.installed, request.Id)
+	if len(node.installed) > installedKept {
+		node.installed = node.installed[1:]
+	}
+	if node.ownership != nil {
+		// no manager to confirm to, see takePage. The owner is answered right away, the
+		// invalidations can take longer than it waits
+		node.lock.Unlock()
+		spawn(node.transport, func() { node.takePage(request, args) })
+		return nil
+	}
 
-		// send a confirmation to the CM
-		node.sendWriteConfirmation(node.currentRequest)
+	if request.TypeOfReq == READ {
+		// update the page in the cache
+		node.installPage(args.PageNum, args.Content, READ)
+		request.Content = args.Content
+	} else {
+		// the page now belongs to this node, apply the pending write to it
+		node.persist(node.installPage(args.PageNum, request.Content, WRITE))
 	}
+	node.currentRequest = nil
+	node.lock.Unlock()
+
+	// the owner is answered right away, the confirmation to the CM can take a while if it fails over
+	spawn(node.transport, func() {
+		var err error
+		if request.TypeOfReq == READ {
+			err = node.sendReadConfirmation(request)
+		} else {
+			err = node.sendWriteConfirmation(request)
+		}
+		if request.done != nil {
+			request.done <- err
+		}
+	})
 	return nil
 }
 
+// installPage updates the cached copy of a page, or adds it to the cache if it is not there.
+// node.lock must be held by the caller
+func (node *Node) installPage(pageNum int, content string, access int) *Page {
+	// the new content replaces an update the node prepared
+	delete(node.prepared, pageNum)
+	for _, page := range node.Pages {
+		if page.PageNum == pageNum {
+			page.Content = content
+			page.Access = access
+			return page
+		}
+	}
+	page := &Page{PageNum: pageNum, Content: content, Access: access}
+	node.Pages = append(node.Pages, page)
+	return page
+}
+
 // SendPage is a RPC method that is called by the page owner node to send a page to a requesting node
 func (node *Node) SendPage(args *SendPageArgs, response *SendPageResponse) error {
-	node.handleSendPage(args)
-	return nil
+	defer node.span("SendPage", args.RequestId, args.PageNum, node.Id)()
+	err := node.handleSendPage(args)
+	response.Clock = node.clock.tick()
+	// the owner keeps a page that was not taken
+	return err
 }
 
-func (node *Node) WriteRequestToCM(pageNum int, content string) error {
-	// make an RPC call to the CM to write the page
-	address := strings.TrimSpace(node.CMaddr[node.currentCM])
-	client, err := rpc.Dial("tcp", address)
-	if err != nil {
-		logInfo(fmt.Sprintf("Error connecting to CM: %s", err))
-		return err
+func (node *Node) WriteRequestToCM(request *Request) error {
+	// a request sent again keeps its id
+	if request.Id == "" {
+		request.Id = node.newRequestId()
 	}
+	defer node.span("WriteRequest", request.Id, request.PageNum, node.Id)()
 
-	defer client.Close()
-
-	req := &WriteRequestArgs{PageNum: pageNum, Content: content, RequesterId: node.Id, Clock: 0}
+	// make an RPC call to the CM to write the page
+	req := &WriteRequestArgs{PageNum: request.PageNum, Content: request.Content, RequesterId: node.Id, RequestId: request.Id, Clock: node.clock.tick()}
 	res := &WriteRequestResponse{}
 
-	node.currentRequest = &Request{PageNum: pageNum, RequesterId: node.Id, Clock: 0, TypeOfReq: WRITE}
-
-	err = client.Call("CentralManager.WriteRequest", req, res)
+	node.log().Info("Sending write request", "page", request.PageNum, "request", request.Id, "clock", req.Clock)
+	err := node.callManager(request.PageNum, "CentralManager.WriteRequest", req, res)
 
 	if err != nil {
-		logInfo(fmt.Sprintf("Error calling WriteRequest: %s", err))
+		node.log().Warn("Error calling WriteRequest", "page", request.PageNum, "request", request.Id, "err", err)
 		return err
 	}
+	node.clock.witness(res.Clock)
 	return nil
 }
 
-func (node *Node) WritePage(pageNum int, content string) (bool, string) {
-	// check if the page is in cache
+func (node *Node) writeTo(pageNum int, content string) bool {
+	// if we hold the page with write access, update it in place
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
 	for _, page := range node.Pages {
 		if page.PageNum == pageNum && page.Access == WRITE {
-			// update the content of the page
-			page.Content += content
-			logInfo(fmt.Sprintf("Updated page %d with content %s", pageNum, page.Content))
-			return true, page.Content
+			page.Content = content
+			node.persist(page)
+			node.log().Info("Updated page", "page", pageNum, "content", page.Content)
+			return true
 		}
 	}
+	return false
+}
 
-	// if page is not in cache, send a write request to the CM
-	node.WriteRequestToCM(pageNum, content)
+// WritePage replaces the content of a page with data. If the node does not hold the page with
+// write access, ownership is requested from the CM, and WritePage blocks until the page has
+// arrived, the write has been applied and the CM has acknowledged the write confirmation.
+func (node *Node) WritePage(ctx context.Context, pageNum int, data []byte) error {
+	invoke := now(node.transport)
+	err := node.writePage(ctx, pageNum, data)
+	node.recordOp("write", pageNum, string(data), invoke, err)
+	return err
+}
+
+func (node *Node) writePage(ctx context.Context, pageNum int, data []byte) error {
+	if node.writeTo(pageNum, string(data)) {
+		node.metrics.localWrites.inc()
+		return nil
+	}
 
-	return false, fmt.Sprintf("write request sent to CM for page %d", pageNum)
+	node.metrics.writeFaults.inc()
+	start := now(node.transport)
+	request := &Request{PageNum: pageNum, RequesterId: node.Id, TypeOfReq: WRITE, Content: string(data)}
+	err := node.fault(ctx, request)
+	if err != nil {
+		node.metrics.faultsFailed.inc()
+		return err
+	}
+	node.metrics.writeFaultSeconds.since(start, now(node.transport))
+	node.spanSince("WriteFault", request, start)
+	return nil
 }
 
 // rpc method called by the CM to forward a write request to the owner of the page
 func (node *Node) WriteForward(args *WriteForwardArgs, res *WriteForwardResponse) error {
 	// invalidate own copy of the page
-	logInfo(fmt.Sprintf("Node %d invalidating page %d", node.Id, args.PageNum))
-	var requestedPage *Page
-	newPages := []*Page{}
-	for _, page := range node.Pages {
-		if page.PageNum == args.PageNum {
-			requestedPage = page
-		} else {
-			newPages = append(newPages, page)
-		}
+	clock := node.clock.witness(args.Clock)
+	node.log().Info("Received write forward", "page", args.PageNum, "requester", args.RequesterId, "request", args.RequestId, "clock", clock)
+	node.metrics.writeForwards.inc()
+	defer node.span("WriteForward", args.RequestId, args.PageNum, args.RequesterId)()
+	node.lock.Lock()
+	if node.handedOver[args.PageNum] == args.RequestId {
+		// the CM sent the forward again after the reply to the first one was lost
+		node.lock.Unlock()
+		return nil
 	}
-
-	node.Pages = newPages
+	node.settleUpdate(args.PageNum, args.Applied)
+	requestedPage := node.findPage(args.PageNum)
+	if requestedPage == nil {
+		node.lock.Unlock()
+		return fmt.Errorf("node %d does not own page %d", node.Id, args.PageNum)
+	}
+	if args.RequesterId != node.Id {
+		requestedPage.Access = handingOver
+	}
+	SendPageArgs := &SendPageArgs{PageNum: requestedPage.PageNum, Content: requestedPage.Content, OwnerId: node.Id, RequestId: args.RequestId, Clock: node.clock.tick()}
+	node.lock.Unlock()
 
 	// forward the page to the requester
-	address := strings.TrimSpace(node.Nodeaddr[args.RequesterId])
-	client, err := rpc.Dial("tcp", address)
+	SendPageResponse := &SendPageResponse{}
+
+	err := node.transport.Call(node.nodeAddress(args.RequesterId), "Node.SendPage", SendPageArgs, SendPageResponse, sendPageTimeout)
 	if err != nil {
-		logInfo(fmt.Sprintf("Error connecting to requester: %s", err))
+		// the requester may have the page even if the reply was lost, so the page is not given its
+		// access back. It is sent again if the CM forwards the write again
+		node.log().Warn("Error sending page to requester", "page", args.PageNum, "requester", args.RequesterId, "err", err)
 		return err
 	}
-	defer client.Close()
+	res.Clock = node.clock.witness(SendPageResponse.Clock)
 
-	SendPageArgs := &SendPageArgs{requestedPage.PageNum, requestedPage.Content, node.Id}
-	SendPageResponse := &SendPageResponse{}
+	node.lock.Lock()
+	if args.RequesterId != node.Id {
+		node.handedOver[args.PageNum] = args.RequestId
+		if page := node.findPage(args.PageNum); page != nil && page.Access == handingOver {
+			node.dropPage(args.PageNum)
+		}
+	}
+	node.lock.Unlock()
+	node.log().Info("Page forwarded to requester", "page", args.PageNum, "requester", args.RequesterId, "request", args.RequestId, "clock", res.Clock)
+	return nil
+}
 
-	err = client.Call("Node.SendPage", SendPageArgs, SendPageResponse)
+// QueryPage asks the CM who owns a page and which nodes hold copies of it
+func (node *Node) QueryPage(pageNum int) (*PageInfoResponse, error) {
+	if node.ownership != nil {
+		return FindOwner(node.transport, node.nodeAddrs(), node.Id, pageNum)
+	}
+	req := &PageInfoArgs{PageNum: pageNum}
+	res := &PageInfoResponse{}
+
+	err := node.callManager(pageNum, "CentralManager.PageInfo", req, res)
 	if err != nil {
-		logInfo(fmt.Sprintf("Error sending page to requester: %s", err))
-		return err
+		return nil, err
+	}
+	return res, nil
+}
+
+// Invalidate is a RPC method that is called by the CM to drop this node's copy of a page before it is written
+func (node *Node) Invalidate(args *InvalidateArgs, res *InvalidateResponse) error {
+	clock := node.clock.witness(args.Clock)
+	node.metrics.invalidations.inc()
+	defer node.span("Invalidate", args.RequestId, args.PageNum, args.RequesterId)()
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	newPages := []*Page{}
+	for _, page := range node.Pages {
+		if page.PageNum != args.PageNum {
+			newPages = append(newPages, page)
+		}
+	}
+	node.Pages = newPages
+	node.unpersist(args.PageNum)
+	// a freed page number may be handed out again, with its updates numbered from the start
+	delete(node.updateSeq, args.PageNum)
+	delete(node.prepared, args.PageNum)
+	if node.ownership != nil {
+		// the writer owns the page now
+		node.pageOwnership(args.PageNum).probOwner = args.RequesterId
+	}
+	node.log().Info("Invalidated copy", "page", args.PageNum, "requester", args.RequesterId, "request", args.RequestId, "clock", clock)
+
+	res.Ack = true
+	res.Clock = node.clock.tick()
+	return nil
+}
+
+// RequestFailed is a RPC method that is called by the CM when it drops this node's current request
+func (node *Node) RequestFailed(args *RequestFailedArgs, res *RequestFailedResponse) error {
+	clock := node.clock.witness(args.Clock)
+	node.log().Warn("Request failed", "page", args.PageNum, "request", args.RequestId, "reason", args.Reason, "clock", clock)
+	res.Clock = node.clock.tick()
+
+	node.lock.Lock()
+	request := node.currentRequest
+	if request == nil || request.Id != args.RequestId {
+		// a late message about a request that has already finished
+		node.lock.Unlock()
+		return errors.New("no matching current request")
 	}
-	logInfo(fmt.Sprintf("Page %d forwarded to requester %d", args.PageNum, args.RequesterId))
+	node.giveUp(request)
+	node.lock.Unlock()
+
+	spawn(node.transport, func() { request.done <- errors.New(args.Reason) })
 	return nil
 }
 
-func NodeStart(nodeId int, currentCM int, CMaddr map[int]string, Nodeaddr map[int]string, pages []*Page, currentNodeAddr string) {
-	node := &Node{
+// NewNode creates a node that reaches the CMs and the other nodes through transport
+func NewNode(nodeId int, currentCM int, CMaddr map[int]string, Nodeaddr map[int]string, pages []*Page, transport Transport) *Node {
+	members := map[int]string{}
+	for id, address := range Nodeaddr {
+		members[id] = address
+	}
+	return &Node{
 		Id:             nodeId,
 		Pages:          pages,
 		currentCM:      currentCM,
 		CMaddr:         CMaddr,
-		Nodeaddr:       Nodeaddr,
+		Nodeaddr:       members,
 		currentRequest: nil,
+		faultSlot:      make(chan struct{}, 1),
+		updateSeq:      map[int]int{},
+		prepared:       map[int]*UpdatePageArgs{},
+		handedOver:     map[int]string{},
+		transport:      transport,
+		metrics:        newNodeMetrics(),
 	}
+}
 
-	err := rpc.Register(node)
+// Start serves the node's RPC methods on address, and the methods of its page manager if it has one
+func (node *Node) Start(address string) error {
+	services := map[string]any{"Node": node}
+	if node.manager != nil {
+		services["CentralManager"] = node.manager
+	}
+	listener, err := node.transport.Serve(address, services)
 	if err != nil {
-		fmt.Println("Error registering Node")
+		return err
 	}
+	node.listener = listener
+
+	if node.manager != nil && node.manager.recovered {
+		// the requests the manager was serving when the node went down are served again
+		node.manager.lock.RLock()
+		records := append([]*PageRecord{}, node.manager.PageRecords...)
+		node.manager.lock.RUnlock()
+		node.manager.inherit(records)
+	}
+	return nil
+}
+
+// Close stops serving the node's RPC methods
+func (node *Node) Close() error {
+	if node.manager != nil {
+		node.manager.Close()
+	}
+	if node.listener == nil {
+		return nil
+	}
+	return node.listener.Close()
+}
 
-	fmt.Println("running node ", nodeId, " at ", currentNodeAddr)
+// NodeOptions configures a node run by NodeStart
+type NodeOptions struct {
+	Id          int // 0 for a node that joins the cluster and takes the id the CM gives it
+	CurrentCM   int // the CM the node asks first, see NewNode
+	CMAddr      map[int]string
+	NodeAddr    map[int]string
+	Pages       []*Page // the pages the node starts out owning
+	Address     string  // the address the node serves on
+	StoreDir    string  // if not empty the node keeps the pages it owns there, see OpenStore
+	MetricsAddr string  // if not empty the node's metrics are served on http://MetricsAddr/metrics
+	TraceFile   string  // if not empty the node records the hops of the requests it handles there, see Tracer
+	HistoryFile string  // if not empty the node records its reads and writes there, see OpenHistory
+	Manager     string  // ManagerDynamic to find the page owners through probable owner chains, see ManageDynamically
+	Managers    []int   // if not nil the nodes manage the pages in place of the CMs, see ManagePages
+	PageRecords []*PageRecord
+}
 
-	go func() {
-		listener, err := net.Listen("tcp", currentNodeAddr)
+// NodeStart runs a node over TCP with a REPL on stdin. A node with a store comes back with the pages
+// it kept there instead of options.Pages, and if the nodes manage the pages the node's page records
+// are logged in StoreDir/manager
+func NodeStart(options NodeOptions) {
+	node := NewNode(options.Id, options.CurrentCM, options.CMAddr, options.NodeAddr, options.Pages, NewTCPTransport())
+	if options.Manager == ManagerDynamic {
+		node.ManageDynamically(options.Managers, options.PageRecords)
+	} else if options.Managers != nil {
+		node.ManagePages(options.Managers, options.PageRecords)
+	}
+	if options.StoreDir != "" {
+		err := node.OpenStore(options.StoreDir)
 		if err != nil {
-			fmt.Println("Error listening")
+			node.log().Error("Error opening page store", "dir", options.StoreDir, "err", err)
+			return
 		}
-		fmt.Println("Node", node.Id, "Listening on ", currentNodeAddr)
-
-		defer listener.Close()
-
-		for {
-			conn, err := listener.Accept()
+		if node.manager != nil {
+			err = node.manager.OpenWAL(filepath.Join(options.StoreDir, "manager"))
 			if err != nil {
-				fmt.Println("Error accepting")
+				node.log().Error("Error opening write-ahead log", "dir", options.StoreDir, "err", err)
+				return
+			}
+		}
+	}
+
+	// the CM has the current addresses of the other nodes, and an id for a node started with 0.
+	// The node joins, and opens its trace and history, before it serves, so that none of them
+	// change under its RPC methods. A new node has no pages, so nobody calls it before it serves
+	if node.managers == nil && node.ownership == nil {
+		err := node.Join(options.Address)
+		if err != nil {
+			node.log().Error("Error joining the cluster", "err", err)
+			if options.Id == 0 {
+				return
 			}
-			go rpc.ServeConn(conn)
 		}
-	}()
+	}
+
+	if options.TraceFile != "" {
+		err := node.OpenTrace(options.TraceFile)
+		if err != nil {
+			node.log().Error("Error opening trace file", "file", options.TraceFile, "err", err)
+			return
+		}
+		defer node.tracer.Close()
+	}
+
+	if options.HistoryFile != "" {
+		history, err := OpenHistory(options.HistoryFile)
+		if err != nil {
+			node.log().Error("Error opening history file", "file", options.HistoryFile, "err", err)
+			return
+		}
+		node.RecordHistory(history)
+		defer history.Close()
+	}
+
+	err := node.Start(options.Address)
+	if err != nil {
+		node.log().Error("Error listening", "address", options.Address, "err", err)
+		return
+	}
+	defer node.Close()
+	node.log().Info("Node listening", "address", options.Address)
+
+	if options.MetricsAddr != "" {
+		server, err := ServeMetrics(options.MetricsAddr, node.WriteMetrics)
+		if err != nil {
+			node.log().Error("Error serving metrics", "address", options.MetricsAddr, "err", err)
+			return
+		}
+		defer server.Close()
+	}
 
 	// Command input handling loop
 	for {
-		fmt.Printf("Node %d> ", nodeId)
+		fmt.Printf("Node %d> ", node.Id)
 		var command string
 		fmt.Scanln(&command)
 
@@ -333,27 +877,96 @@ func NodeStart(nodeId int, currentCM int, CMaddr map[int]string, Nodeaddr map[in
 				continue
 			}
 
-			// Call the node's `readFrom` method
-			isLocalRead, content := node.readFrom(pageNum)
-
-			if isLocalRead {
-				fmt.Println(content)
-			} else {
-				fmt.Println("Page not found in cache. Request sent to CM.")
+			ctx, cancel := context.WithTimeout(context.Background(), replTimeout)
+			content, err := node.ReadPage(ctx, pageNum)
+			cancel()
+			if err != nil {
+				fmt.Println("Error reading page:", err)
+				continue
 			}
+			fmt.Println(string(content))
 
 		case "pages":
 			// List all cached pages
 			fmt.Println("Cached pages:")
+			node.lock.Lock()
 			for _, page := range node.Pages {
 				fmt.Printf("Page %d: %s: %d\n", page.PageNum, page.Content, page.Access)
 			}
+			node.lock.Unlock()
+
+		case "info":
+			// Show the CM's record of a page
+			fmt.Print("Enter page number: ")
+			var pageNum int
+			_, err := fmt.Scanln(&pageNum)
+			if err != nil {
+				fmt.Println("Invalid input:", err)
+				continue
+			}
+
+			info, err := node.QueryPage(pageNum)
+			if err != nil {
+				fmt.Println("Error querying page:", err)
+				continue
+			}
+			fmt.Printf("Page %d: owner %d, copyset %v, %d waiting\n", info.PageNum, info.Owner, info.CopySet, info.Waiting)
+
+		case "alloc":
+			// Create a new page owned by this node
+			fmt.Print("Enter coherence policy, invalidate or update (empty for invalidate): ")
+			var policy string
+			fmt.Scanln(&policy)
+			pageNum, err := node.AllocatePage(policy)
+			if err != nil {
+				fmt.Println("Error allocating page:", err)
+				continue
+			}
+			fmt.Println("Allocated page", pageNum)
+
+		case "free":
+			// Delete a page from every node
+			fmt.Print("Enter page number to free: ")
+			var pageNum int
+			_, err := fmt.Scanln(&pageNum)
+			if err != nil {
+				fmt.Println("Invalid input:", err)
+				continue
+			}
+
+			err = node.FreePage(pageNum)
+			if err != nil {
+				fmt.Println("Error freeing page:", err)
+				continue
+			}
+			fmt.Println("Freed page", pageNum)
+
+		case "list":
+			// Show the CM's record of every page
+			pages, err := node.ListPages()
+			if err != nil {
+				fmt.Println("Error listing pages:", err)
+				continue
+			}
+			for _, info := range pages {
+				fmt.Printf("Page %d: owner %d, copyset %v, %d waiting\n", info.PageNum, info.Owner, info.CopySet, info.Waiting)
+			}
 
 		case "exit":
 			// Exit the node
 			fmt.Println("Shutting down node...")
 			return
 
+		case "leave":
+			// Deregister from the CM, then exit
+			err := node.Leave()
+			if err != nil {
+				fmt.Println("Error leaving the cluster:", err)
+				continue
+			}
+			fmt.Println("Left the cluster, shutting down node...")
+			return
+
 		case "write":
 			// Read page number and content from user
 			fmt.Print("Enter page number to write: ")
@@ -371,17 +984,17 @@ func NodeStart(nodeId int, currentCM int, CMaddr map[int]string, Nodeaddr map[in
 				fmt.Println("Invalid input:", err)
 				continue
 			}
-			// Call the node's `WritePage` method
-			isLocalWrite, newContent := node.WritePage(pageNum, content)
-
-			if isLocalWrite {
-				fmt.Println("Updated page content:", newContent)
-			} else {
-				fmt.Println(newContent)
+			ctx, cancel := context.WithTimeout(context.Background(), replTimeout)
+			err = node.WritePage(ctx, pageNum, []byte(content))
+			cancel()
+			if err != nil {
+				fmt.Println("Error writing page:", err)
+				continue
 			}
+			fmt.Println("Updated page content:", content)
 
 		default:
-			fmt.Println("Unknown command. Available commands: read, write, pages, exit")
+			fmt.Println("Unknown command. Available commands: read, write, pages, info, alloc, free, list, leave, exit")
 		}
 	}
 }
@@ -0,0 +1,337 @@
+package ivy
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sort"
+)
+
+// removeRecord takes a page out of the page table. cm.lock must be held
+func (cm *CentralManager) removeRecord(pageNum int) {
+	if pr := cm.records[pageNum]; pr != nil {
+		cm.freed[pageNum] = pr
+	}
+	delete(cm.records, pageNum)
+	pageRecords := []*PageRecord{}
+	for _, pr := range cm.PageRecords {
+		if pr.PageNum != pageNum {
+			pageRecords = append(pageRecords, pr)
+		}
+	}
+	cm.PageRecords = pageRecords
+}
+
+// AllocatePage rpc called by a node to create a new page. The page gets the next page number after
+// the highest one in use, and the requester becomes its owner with empty contents once it confirms
+// that it installed the page. Until then the allocation is in flight and the requests for the page
+// wait behind it. A CM that is one of several page managers only hands out the page numbers it manages
+func (cm *CentralManager) AllocatePage(args *AllocatePageArgs, res *AllocatePageResponse) error {
+	if err := cm.checkPrimary(); err != nil {
+		return err
+	}
+	clock := cm.clock.witness(args.Clock)
+	defer func() { res.Clock = cm.clock.tick() }()
+	defer cm.span("AllocatePage", args.RequestId, 0, args.RequesterId)()
+
+	if err := checkPolicy("", args.Policy); err != nil {
+		return err
+	}
+
+	cm.lock.Lock()
+	if _, isMember := cm.nodeAddr[args.RequesterId]; !isMember {
+		cm.lock.Unlock()
+		return fmt.Errorf("node %d is not a member", args.RequesterId)
+	}
+	if pr, err := cm.allocated(args.RequesterId, args.RequestId); pr != nil {
+		// the reply to the allocation was lost and the node sent it again
+		cm.lock.Unlock()
+		cm.log().Info("Page already allocated", "page", pr.PageNum, "requester", args.RequesterId, "request", args.RequestId)
+		res.PageNum = pr.PageNum
+		return err
+	}
+	pageNum := 1
+	for num := range cm.records {
+		if num >= pageNum {
+			pageNum = num + 1
+		}
+	}
+	if cm.stride > 0 {
+		for pageNum%cm.stride != cm.offset {
+			pageNum++
+		}
+	}
+	request := &Request{Id: args.RequestId, PageNum: pageNum, RequesterId: args.RequesterId, Clock: args.Clock, TypeOfReq: ALLOCATE}
+	pr := &PageRecord{PageNum: pageNum, CopySet: []int{}, Policy: args.Policy, inFlight: request}
+	cm.records[pageNum] = pr
+	delete(cm.freed, pageNum)
+	cm.PageRecords = append(cm.PageRecords, pr)
+	cm.lock.Unlock()
+
+	pr.lock.Lock()
+	state, err := cm.snapshot(pr)
+	pr.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := cm.replicate(state); err != nil {
+		return err
+	}
+
+	cm.log().Info("Allocated page", "page", pageNum, "requester", args.RequesterId, "request", args.RequestId, "clock", clock)
+	res.PageNum = pageNum
+	return nil
+}
+
+// allocated returns the page allocated for the request with id, and the error the allocation failed
+// with if it did not go through. It returns nil if there is no such page. cm.lock must be held
+func (cm *CentralManager) allocated(requesterId int, id string) (*PageRecord, error) {
+	for _, pr := range cm.PageRecords {
+		pr.lock.Lock()
+		inFlight := pr.inFlight != nil && pr.inFlight.Id == id && pr.inFlight.TypeOfReq == ALLOCATE
+		served := pr.findServed(requesterId, id)
+		pr.lock.Unlock()
+		if inFlight {
+			return pr, nil
+		}
+		if served != nil {
+			return pr, served.err()
+		}
+	}
+	return nil, nil
+}
+
+// serveAllocate is only called for an allocation left over from a previous primary that the
+// requester did not confirm within inheritTimeout. The requester is gone, so the page is dropped
+func (cm *CentralManager) serveAllocate(pr *PageRecord, request *Request) error {
+	cm.log().Warn("Dropping unconfirmed page", "page", request.PageNum, "requester", request.RequesterId, "request", request.Id)
+	return cm.discard(pr, request, errors.New("allocation not confirmed"))
+}
+
+// FreePage rpc called by a node to delete a page. The free is queued behind the requests already
+// waiting for the page, every copy including the owner's is invalidated and the requests queued
+// after it fail. The call returns once the page is gone
+func (cm *CentralManager) FreePage(args *FreePageArgs, res *FreePageResponse) error {
+	if err := cm.checkPrimary(); err != nil {
+		return err
+	}
+	clock := cm.clock.witness(args.Clock)
+	cm.log().Info("Free request", "page", args.PageNum, "requester", args.RequesterId, "request", args.RequestId, "clock", clock)
+	cm.metrics.freeRequests.inc()
+	defer func() { res.Clock = cm.clock.tick() }()
+	defer cm.span("FreePage", args.RequestId, args.PageNum, args.RequesterId)()
+
+	request := &Request{Id: args.RequestId, PageNum: args.PageNum, RequesterId: args.RequesterId, Clock: args.Clock, TypeOfReq: FREE}
+	// a free the node sent again waits here with the first copy, and both get its result
+	wait := cm.waitFree(request.Id)
+	queued, err := cm.enqueue(request)
+	if err != nil || queued == nil {
+		cm.finishFree(request.Id, err)
+		return err
+	}
+	<-wait.done
+	return wait.err
+}
+
+// freeWait is what the FreePage RPCs for one free wait on
+type freeWait struct {
+	done chan struct{} // closed when the free is over
+	err  error
+}
+
+// waitFree returns what the FreePage RPCs for the free with id wait on
+func (cm *CentralManager) waitFree(id string) *freeWait {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	wait := cm.frees[id]
+	if wait == nil {
+		wait = &freeWait{done: make(chan struct{})}
+		cm.frees[id] = wait
+	}
+	return wait
+}
+
+// finishFree gives the result of the free with id to the FreePage RPCs waiting for it, and reports
+// whether there were any
+func (cm *CentralManager) finishFree(id string, reason error) bool {
+	cm.lock.Lock()
+	wait := cm.frees[id]
+	delete(cm.frees, id)
+	cm.lock.Unlock()
+	if wait == nil {
+		return false
+	}
+	wait.err = reason
+	spawn(cm.transport, func() { close(wait.done) })
+	return true
+}
+
+// serveFree invalidates every copy of a page and removes it from the page table
+func (cm *CentralManager) serveFree(pr *PageRecord, request *Request) error {
+	pr.lock.Lock()
+	ownerId := pr.Owner
+	copySet := []int{}
+	for _, nodeId := range pr.CopySet {
+		if nodeId != ownerId {
+			copySet = append(copySet, nodeId)
+		}
+	}
+	pr.lock.Unlock()
+
+	// the owner goes last, so the page still has an owner if a copy cannot be invalidated
+	cm.metrics.invalidationsPerOp.observe(float64(len(copySet) + 1))
+	acked, err := cm.invalidateCopies(request, copySet)
+	if dropErr := cm.dropCopies(pr, acked); dropErr != nil {
+		return dropErr
+	}
+	if err != nil {
+		return err
+	}
+	_, err = cm.invalidateCopies(request, []int{ownerId})
+	if err != nil {
+		return err
+	}
+
+	if err := cm.discard(pr, request, nil); err != nil {
+		// the free is no longer in flight, so serve does not fail it
+		cm.finishFree(request.Id, err)
+		return err
+	}
+	cm.finishFree(request.Id, nil)
+	return nil
+}
+
+// discard takes a page out of the page table and fails the requests waiting for it. request, the
+// one in flight, is remembered as failed with reason, or as served if reason is nil
+func (cm *CentralManager) discard(pr *PageRecord, request *Request, reason error) error {
+	pr.lock.Lock()
+	pr.freed = true
+	pr.CopySet = []int{}
+	pr.inFlight = nil
+	waiting := pr.queue
+	pr.queue = nil
+	pr.remember(request, reason)
+	for _, waitingRequest := range waiting {
+		pr.remember(waitingRequest, errors.New("page freed"))
+	}
+	state, err := cm.snapshot(pr)
+	pr.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	cm.lock.Lock()
+	cm.removeRecord(request.PageNum)
+	cm.lock.Unlock()
+	if err := cm.replicate(state); err != nil {
+		return err
+	}
+
+	cm.log().Info("Freed page", "page", request.PageNum, "requester", request.RequesterId, "request", request.Id, "failed", len(waiting))
+	for _, waitingRequest := range waiting {
+		cm.sendRequestFailed(waitingRequest, errors.New("page freed"))
+	}
+	return nil
+}
+
+// ListPages rpc returns what the CM has on record for every page, in page order
+func (cm *CentralManager) ListPages(args *ListPagesArgs, res *ListPagesResponse) error {
+	cm.lock.RLock()
+	pageNums := []int{}
+	for pageNum := range cm.records {
+		pageNums = append(pageNums, pageNum)
+	}
+	cm.lock.RUnlock()
+	sort.Ints(pageNums)
+
+	res.Pages = []PageInfoResponse{}
+	for _, pageNum := range pageNums {
+		info := PageInfoResponse{}
+		if err := cm.PageInfo(&PageInfoArgs{PageNum: pageNum}, &info); err != nil {
+			// freed in the meantime
+			continue
+		}
+		res.Pages = append(res.Pages, info)
+	}
+	return nil
+}
+
+// AllocatePage asks the CM for a new page with a coherence policy, empty for the default, and installs
+// it, empty and writable. If the nodes manage the pages the node asks its own manager, so the new page
+// is one the node manages, and under the dynamic distributed manager the node allocates the page itself
+func (node *Node) AllocatePage(policy string) (int, error) {
+	if node.ownership != nil {
+		if err := checkPolicy(ManagerDynamic, policy); err != nil {
+			return 0, err
+		}
+		pageNum := node.allocateOwnPage()
+		node.log().Info("Allocated page", "page", pageNum)
+		return pageNum, nil
+	}
+	req := &AllocatePageArgs{RequesterId: node.Id, RequestId: node.newRequestId(), Policy: policy, Clock: node.clock.tick()}
+	defer node.span("AllocatePage", req.RequestId, 0, node.Id)()
+	res := &AllocatePageResponse{}
+
+	var err error
+	if node.managers == nil {
+		err = node.callCM("CentralManager.AllocatePage", req, res)
+	} else {
+		err = node.transport.Call(node.nodeAddress(node.Id), "CentralManager.AllocatePage", req, res, cmCallTimeout)
+	}
+	if err != nil {
+		return 0, err
+	}
+	clock := node.clock.witness(res.Clock)
+
+	node.lock.Lock()
+	node.persist(node.installPage(res.PageNum, "", WRITE))
+	node.lock.Unlock()
+
+	// the page is the node's once the CM knows it is installed, see CentralManager.AllocatePage
+	request := &Request{Id: req.RequestId, PageNum: res.PageNum, RequesterId: node.Id, TypeOfReq: ALLOCATE}
+	if err := node.sendWriteConfirmation(request); err != nil {
+		if _, refused := err.(rpc.ServerError); refused {
+			// the CM dropped the allocation, a page that was not confirmed is kept in case it was
+			node.lock.Lock()
+			node.dropPage(res.PageNum)
+			node.lock.Unlock()
+		}
+		return 0, err
+	}
+	node.log().Info("Allocated page", "page", res.PageNum, "request", req.RequestId, "clock", clock)
+	return res.PageNum, nil
+}
+
+// FreePage asks the CM to delete a page from every node
+func (node *Node) FreePage(pageNum int) error {
+	if node.ownership != nil {
+		return errFreeUnsupported
+	}
+	req := &FreePageArgs{PageNum: pageNum, RequesterId: node.Id, RequestId: node.newRequestId(), Clock: node.clock.tick()}
+	defer node.span("FreePage", req.RequestId, pageNum, node.Id)()
+	res := &FreePageResponse{}
+
+	err := node.callManager(pageNum, "CentralManager.FreePage", req, res)
+	if err != nil {
+		return err
+	}
+	node.clock.witness(res.Clock)
+	return nil
+}
+
+// ListPages asks the CM for the owner and copy set of every page
+func (node *Node) ListPages() ([]PageInfoResponse, error) {
+	if node.ownership != nil {
+		return ListOwnedPages(node.transport, node.nodeAddrs())
+	}
+	if node.managers != nil {
+		return node.listManagedPages()
+	}
+	res := &ListPagesResponse{}
+
+	err := node.callCM("CentralManager.ListPages", &ListPagesArgs{}, res)
+	if err != nil {
+		return nil, err
+	}
+	return res.Pages, nil
+}
@@ -0,0 +1,171 @@
+package ivy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PageStore keeps the pages a node owns on disk, one file per page, so that an owner that crashes
+// comes back with its pages. Every file is replaced atomically by writing a temporary file and
+// renaming it over the old one
+type PageStore struct {
+	dir string
+}
+
+// OpenPageStore opens the store in dir, creating dir if needed. created reports whether the store is
+// new, in which case the node starts from its configured pages instead of the stored ones
+func OpenPageStore(dir string) (store *PageStore, created bool, err error) {
+	_, err = os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		created = true
+	} else if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, false, err
+	}
+	return &PageStore{dir: dir}, created, nil
+}
+
+func (store *PageStore) path(pageNum int) string {
+	return filepath.Join(store.dir, fmt.Sprintf("page-%d.json", pageNum))
+}
+
+// Save writes a page to disk, replacing what was stored for it before
+func (store *PageStore) Save(page *Page) error {
+	data, err := json.Marshal(page)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(store.dir, "page-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once the file has been renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// the contents must be on disk before the rename makes them visible
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), store.path(page.PageNum)); err != nil {
+		return err
+	}
+	return store.syncDir()
+}
+
+// Remove deletes a page from disk. Removing a page that is not stored is not an error
+func (store *PageStore) Remove(pageNum int) error {
+	err := os.Remove(store.path(pageNum))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return store.syncDir()
+}
+
+// syncDir makes a rename or remove in the store durable
+func (store *PageStore) syncDir() error {
+	dir, err := os.Open(store.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Load reads every stored page, in page order. Temporary files left by a crash are skipped
+func (store *PageStore) Load() ([]*Page, error) {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := []*Page{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "page-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		pageNum, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "page-"), ".json"))
+		if err != nil {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(store.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		page := &Page{}
+		if err := json.Unmarshal(data, page); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if page.PageNum != pageNum {
+			return nil, fmt.Errorf("%s holds page %d", name, page.PageNum)
+		}
+		pages = append(pages, page)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].PageNum < pages[j].PageNum })
+	return pages, nil
+}
+
+// OpenStore makes the node keep the pages it owns in a PageStore in dir. A new store is filled with
+// the node's current pages, an existing one replaces them with the pages stored in it
+func (node *Node) OpenStore(dir string) error {
+	store, created, err := OpenPageStore(dir)
+	if err != nil {
+		return err
+	}
+
+	node.lock.Lock()
+	defer node.lock.Unlock()
+
+	if created {
+		for _, page := range node.Pages {
+			if err := store.Save(page); err != nil {
+				return err
+			}
+		}
+	} else {
+		pages, err := store.Load()
+		if err != nil {
+			return err
+		}
+		node.Pages = pages
+	}
+	node.store = store
+	return nil
+}
+
+// persist saves a page this node owns if it has a store. node.lock must be held
+func (node *Node) persist(page *Page) {
+	if node.store == nil {
+		return
+	}
+	if err := node.store.Save(page); err != nil {
+		node.log().Error("Error saving page", "page", page.PageNum, "err", err)
+	}
+}
+
+// unpersist removes a page this node no longer owns from its store. node.lock must be held
+func (node *Node) unpersist(pageNum int) {
+	if node.store == nil {
+		return
+	}
+	if err := node.store.Remove(pageNum); err != nil {
+		node.log().Error("Error removing page", "page", pageNum, "err", err)
+	}
+}
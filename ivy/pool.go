@@ -0,0 +1,125 @@
+package ivy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientPool keeps one persistent RPC client per address, so that a protocol message costs
+// a round trip instead of a connect plus a round trip. A client is dialled on first use and
+// dropped when its connection fails, the next call dials again. Safe for concurrent use,
+// net/rpc clients multiplex concurrent calls over one connection
+type clientPool struct {
+	lock    sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+func newClientPool() *clientPool {
+	return &clientPool{clients: map[string]*rpc.Client{}}
+}
+
+// get returns the client for address, dialling it if there is none. reused is false for a new connection
+func (pool *clientPool) get(address string, timeout time.Duration) (client *rpc.Client, reused bool, err error) {
+	pool.lock.Lock()
+	client = pool.clients[address]
+	pool.lock.Unlock()
+	if client != nil {
+		return client, true, nil
+	}
+
+	var conn net.Conn
+	if timeout > 0 {
+		conn, err = net.DialTimeout("tcp", address, timeout)
+	} else {
+		conn, err = net.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	client = rpc.NewClient(conn)
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if existing := pool.clients[address]; existing != nil {
+		// another call dialled at the same time, use its client
+		client.Close()
+		return existing, true, nil
+	}
+	pool.clients[address] = client
+	return client, false, nil
+}
+
+// close closes every client, the calls still waiting on them fail
+func (pool *clientPool) close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for address, client := range pool.clients {
+		client.Close()
+		delete(pool.clients, address)
+	}
+}
+
+// drop closes the client for address if it is still the one given
+func (pool *clientPool) drop(address string, client *rpc.Client) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.clients[address] == client {
+		client.Close()
+		delete(pool.clients, address)
+	}
+}
+
+// call makes an RPC call to address. A timeout of 0 waits for as long as the call takes.
+// If a cached connection turns out to have been closed before the call was sent, the call is
+// made once more on a new connection
+func (pool *clientPool) call(address string, method string, args any, reply any, timeout time.Duration) error {
+	address = strings.TrimSpace(address)
+	client, reused, err := pool.get(address, timeout)
+	if err != nil {
+		return err
+	}
+
+	err = pool.send(client, method, args, reply, timeout)
+	if err == rpc.ErrShutdown && reused {
+		pool.drop(address, client)
+		client, _, err = pool.get(address, timeout)
+		if err != nil {
+			return err
+		}
+		err = pool.send(client, method, args, reply, timeout)
+	}
+
+	if connectionBroken(err) {
+		// start over next time. A call that timed out is only given up, the connection is shared
+		// with the other calls to address and may still be fine
+		pool.drop(address, client)
+	}
+	return err
+}
+
+// connectionBroken reports whether err means that a client's connection can no longer be used, as
+// opposed to an error returned by the server or a call that timed out
+func connectionBroken(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+func (pool *clientPool) send(client *rpc.Client, method string, args any, reply any, timeout time.Duration) error {
+	if timeout <= 0 {
+		return client.Call(method, args, reply)
+	}
+
+	select {
+	case call := <-client.Go(method, args, reply, make(chan *rpc.Call, 1)).Done:
+		return call.Error
+	case <-time.After(timeout):
+		return errors.New("timed out")
+	}
+}
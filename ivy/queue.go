@@ -0,0 +1,24 @@
+package ivy
+
+// requestQueue holds the requests waiting on one page, ordered by Clock and then by arrival
+type requestQueue []*Request
+
+func (q *requestQueue) push(request *Request) {
+	// insert after every request with a clock not later than this one
+	i := len(*q)
+	for i > 0 && (*q)[i-1].Clock > request.Clock {
+		i--
+	}
+	*q = append(*q, nil)
+	copy((*q)[i+1:], (*q)[i:])
+	(*q)[i] = request
+}
+
+func (q *requestQueue) pop() *Request {
+	if len(*q) == 0 {
+		return nil
+	}
+	request := (*q)[0]
+	*q = (*q)[1:]
+	return request
+}
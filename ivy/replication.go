@@ -0,0 +1,495 @@
+package ivy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatInterval = 500 * time.Millisecond
+	failoverTimeout   = 2 * time.Second // a backup takes over after this long without a heartbeat
+	replicateTimeout  = time.Second
+	inheritTimeout    = 5 * time.Second // in-flight requests taken over from a failed primary are served after this long if nobody retries them
+	leaseTimeout      = time.Second     // the primary steps down after this long without an ack from one of its backups, before that backup takes over
+)
+
+var errNotPrimary = errors.New("not the primary CM")
+
+func (cm *CentralManager) checkPrimary() error {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+
+	if !cm.isPrimary {
+		return errNotPrimary
+	}
+	return nil
+}
+
+// otherCMs returns the ids of every other CM in ascending order
+func (cm *CentralManager) otherCMs() []int {
+	ids := []int{}
+	for id := range cm.peers {
+		if id != cm.Id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// replicate sends the state of a page to every backup, see sendReplicate
+func (cm *CentralManager) replicate(state PageRecordState) error {
+	return cm.sendReplicate(ReplicateArgs{Records: []PageRecordState{state}}, fmt.Sprintf("page %d", state.PageNum))
+}
+
+// sendReplicate sends args to every backup at the same time and waits for all of them. A backup
+// that has acknowledged this primary before is sent args again until it acknowledges, so a change
+// is not acted on before it could be taken over. If the backup stays silent the primary loses its
+// lease and steps down, and sendReplicate returns errNotPrimary. Other backups are tried once and
+// skipped if they do not answer, they catch up on the next change to the page
+func (cm *CentralManager) sendReplicate(args ReplicateArgs, what string) error {
+	cm.lock.RLock()
+	isPrimary := cm.isPrimary
+	epoch := cm.epoch
+	cm.lock.RUnlock()
+	if !isPrimary {
+		return errNotPrimary
+	}
+
+	backups := cm.otherCMs()
+	errs := make([]error, len(backups))
+	var wg sync.WaitGroup
+	for i, cmId := range backups {
+		wg.Add(1)
+		spawn(cm.transport, func() {
+			defer wg.Done()
+			for {
+				req := args
+				req.PrimaryId = cm.Id
+				req.Epoch = epoch
+				req.Clock = cm.clock.tick()
+				sent := now(cm.transport)
+				err := cm.transport.Call(cm.peers[cmId], "CentralManager.Replicate", &req, &ReplicateResponse{}, replicateTimeout)
+				if err == nil {
+					cm.acked(cmId, epoch, sent)
+					return
+				}
+				cm.log().Warn("Error replicating", "what", what, "backup", cmId, "err", err)
+
+				cm.lock.RLock()
+				stillPrimary := cm.isPrimary && cm.epoch == epoch
+				_, following := cm.acks[cmId]
+				cm.lock.RUnlock()
+				if !stillPrimary {
+					errs[i] = errNotPrimary
+					return
+				}
+				if !following {
+					return
+				}
+				<-after(cm.transport, heartbeatInterval)
+			}
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// acked records that backup cmId acknowledged a message sent at sent by this CM as the primary of
+// epoch. The lease of the primary runs from when the message was sent, which is before the
+// backup got it and restarted its failover timer
+func (cm *CentralManager) acked(cmId int, epoch int, sent time.Time) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.isPrimary && cm.epoch == epoch && sent.After(cm.acks[cmId]) {
+		cm.acks[cmId] = sent
+	}
+}
+
+// leaseExpired reports whether a backup that acknowledged this primary has not done so for
+// leaseTimeout. The backup may have been cut off from the primary and be about to take over.
+// A primary that never heard from a backup, like one that took over from a failed CM, holds
+// no lease and serves on its own. cm.lock must be held
+func (cm *CentralManager) leaseExpired() bool {
+	for _, sent := range cm.acks {
+		if now(cm.transport).Sub(sent) > leaseTimeout {
+			return true
+		}
+	}
+	return false
+}
+
+// Replicate rpc called by the primary CM on its backups after every change to a page record
+func (cm *CentralManager) Replicate(args *ReplicateArgs, res *ReplicateResponse) error {
+	cm.lock.Lock()
+	if cm.isPrimary {
+		if !cm.yields(args.PrimaryId, args.Epoch) {
+			cm.lock.Unlock()
+			return fmt.Errorf("CM %d is the primary, not accepting state from CM %d", cm.Id, args.PrimaryId)
+		}
+		cm.stepDown(args.PrimaryId, args.Epoch)
+	}
+	if args.Epoch < cm.epoch {
+		cm.lock.Unlock()
+		return fmt.Errorf("CM %d is primary in epoch %d, not accepting state from CM %d of epoch %d", cm.primaryId, cm.epoch, args.PrimaryId, args.Epoch)
+	}
+	cm.epoch = args.Epoch
+	cm.primaryId = args.PrimaryId
+	cm.lastHeartbeat = now(cm.transport)
+	cm.followAfterLease(args.PrimaryId)
+	cm.lock.Unlock()
+
+	cm.clock.witness(args.Clock)
+	if err := cm.restore(args.Records); err != nil {
+		return err
+	}
+	if args.Members != nil {
+		return cm.setMembers(args.Members, args.MembersVersion)
+	}
+	return nil
+}
+
+// restore applies replicated page states, adding records for pages this CM has not seen yet
+// and removing the ones that were freed. It stops at the first state that cannot be logged
+func (cm *CentralManager) restore(states []PageRecordState) error {
+	cm.lock.Lock()
+	records := []*PageRecord{}
+	for _, state := range states {
+		pr := cm.records[state.PageNum]
+		if pr == nil {
+			pr = &PageRecord{PageNum: state.PageNum}
+			cm.records[state.PageNum] = pr
+			delete(cm.freed, state.PageNum)
+			cm.PageRecords = append(cm.PageRecords, pr)
+		}
+		if state.Freed {
+			cm.removeRecord(state.PageNum)
+		}
+		records = append(records, pr)
+	}
+	cm.lock.Unlock()
+
+	for i, pr := range records {
+		pr.lock.Lock()
+		if pr.restore(states[i]) {
+			if err := cm.logRecord(states[i]); err != nil {
+				pr.lock.Unlock()
+				return err
+			}
+		}
+		pr.lock.Unlock()
+	}
+	return nil
+}
+
+// states returns the state of every page record
+func (cm *CentralManager) states() []PageRecordState {
+	cm.lock.RLock()
+	records := append([]*PageRecord{}, cm.PageRecords...)
+	cm.lock.RUnlock()
+
+	states := []PageRecordState{}
+	for _, pr := range records {
+		pr.lock.Lock()
+		states = append(states, pr.state())
+		pr.lock.Unlock()
+	}
+	return states
+}
+
+// Heartbeat rpc called periodically by the primary CM on its backups
+func (cm *CentralManager) Heartbeat(args *HeartbeatArgs, res *HeartbeatResponse) error {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	if cm.isPrimary {
+		if !cm.yields(args.PrimaryId, args.Epoch) {
+			return fmt.Errorf("CM %d is the primary, ignoring heartbeat from CM %d", cm.Id, args.PrimaryId)
+		}
+		cm.stepDown(args.PrimaryId, args.Epoch)
+	}
+	if args.Epoch < cm.epoch {
+		return fmt.Errorf("CM %d is primary in epoch %d, ignoring heartbeat from CM %d of epoch %d", cm.primaryId, cm.epoch, args.PrimaryId, args.Epoch)
+	}
+	cm.epoch = args.Epoch
+	cm.primaryId = args.PrimaryId
+	cm.lastHeartbeat = now(cm.transport)
+	cm.followAfterLease(args.PrimaryId)
+	return nil
+}
+
+// followAfterLease syncs with primaryId if this CM stepped down when its lease expired. It may
+// have changed pages that its backup never got before it stepped down. cm.lock must be held
+func (cm *CentralManager) followAfterLease(primaryId int) {
+	if !cm.leaseLost {
+		return
+	}
+	cm.leaseLost = false
+	spawn(cm.transport, func() { cm.resync(primaryId) })
+}
+
+// yields reports whether this CM, as primary, should step down for CM primaryId that is primary in
+// epoch. Of two primaries the one of the later epoch stays, and in the same epoch the one with the
+// higher id. cm.lock must be held
+func (cm *CentralManager) yields(primaryId int, epoch int) bool {
+	return epoch > cm.epoch || (epoch == cm.epoch && primaryId > cm.Id)
+}
+
+// stepDown makes this CM a backup of primaryId after both acted as primary, and then replaces the
+// page table with the primary's, which wins where the two differ. cm.lock must be held
+func (cm *CentralManager) stepDown(primaryId int, epoch int) {
+	cm.log().Warn("Another CM is primary, stepping down", "primary", primaryId, "epoch", epoch, "ownEpoch", cm.epoch)
+	cm.isPrimary = false
+	cm.primaryId = primaryId
+	cm.epoch = epoch
+	cm.lastHeartbeat = now(cm.transport)
+	cm.acks = map[int]time.Time{}
+	cm.leaseLost = false
+	spawn(cm.transport, func() { cm.resync(primaryId) })
+}
+
+// resync replaces the page table and membership of this CM with the ones of primaryId
+func (cm *CentralManager) resync(primaryId int) {
+	res := &SyncResponse{}
+	err := cm.transport.Call(cm.peers[primaryId], "CentralManager.Sync", &SyncArgs{}, res, replicateTimeout)
+	if err != nil {
+		cm.log().Warn("Error syncing with the primary", "primary", primaryId, "err", err)
+		return
+	}
+
+	cm.lock.RLock()
+	records := append([]*PageRecord{}, cm.PageRecords...)
+	cm.lock.RUnlock()
+	for _, pr := range records {
+		// this CM may have changed a page more often than the primary did while both were primary,
+		// or the primary may not have changed it at all since it started
+		pr.lock.Lock()
+		pr.version = -1
+		pr.lock.Unlock()
+	}
+	if err := cm.restore(res.Records); err != nil {
+		cm.log().Error("Error restoring the primary's pages", "primary", primaryId, "err", err)
+		return
+	}
+	if err := cm.setMembers(res.Members, res.MembersVersion); err != nil {
+		cm.log().Error("Error restoring the primary's members", "primary", primaryId, "err", err)
+		return
+	}
+	// the log drops a page state that is not newer than the one it has, so it is written out
+	// again from the synced state, or a restart would bring back this CM's own versions
+	if cm.wal != nil {
+		cm.lock.RLock()
+		members, version := cm.members()
+		cm.lock.RUnlock()
+		if err := cm.wal.Reset(walSnapshot{Records: cm.states(), Members: members, MembersVersion: version}); err != nil {
+			cm.log().Error("Error writing the synced state to the log", "err", err)
+			cm.logFailed(err)
+			return
+		}
+	}
+	cm.log().Info("Synced with the primary", "primary", primaryId, "pages", len(res.Records))
+}
+
+// heartbeatLoop sends heartbeats while this CM is the primary, and watches for the primary's
+// heartbeats while it is a backup
+func (cm *CentralManager) heartbeatLoop() {
+	for {
+		select {
+		case <-after(cm.transport, heartbeatInterval):
+		case <-cm.quit:
+			return
+		}
+
+		cm.lock.RLock()
+		isPrimary := cm.isPrimary
+		primaryId := cm.primaryId
+		epoch := cm.epoch
+		sinceHeartbeat := now(cm.transport).Sub(cm.lastHeartbeat)
+		walFailed := cm.walFailed
+		leaseLost := cm.leaseLost
+		cm.lock.RUnlock()
+
+		if isPrimary {
+			cm.lock.Lock()
+			if cm.isPrimary && cm.epoch == epoch && cm.leaseExpired() {
+				// until it hears from a primary again this CM does not take over either, the
+				// backup that went silent may be serving as the primary by now
+				cm.log().Error("Lease expired, stepping down", "epoch", epoch)
+				cm.isPrimary = false
+				cm.leaseLost = true
+				cm.lock.Unlock()
+				continue
+			}
+			cm.lock.Unlock()
+
+			for _, cmId := range cm.otherCMs() {
+				address := cm.peers[cmId]
+				spawn(cm.transport, func() {
+					sent := now(cm.transport)
+					err := cm.transport.Call(address, "CentralManager.Heartbeat", &HeartbeatArgs{PrimaryId: cm.Id, Epoch: epoch}, &HeartbeatResponse{}, heartbeatInterval)
+					if err == nil {
+						cm.acked(cmId, epoch, sent)
+					}
+				})
+			}
+			continue
+		}
+
+		// with several backups, the one with the lowest id takes over first
+		rank := 1
+		for _, cmId := range cm.otherCMs() {
+			if cmId != primaryId && cmId < cm.Id {
+				rank++
+			}
+		}
+		if sinceHeartbeat > failoverTimeout*time.Duration(rank) && !walFailed && !leaseLost {
+			cm.log().Warn("No heartbeat from the primary", "primary", primaryId, "since", sinceHeartbeat)
+			cm.takeOver(primaryId)
+		}
+	}
+}
+
+// takeOver makes this CM the primary after the previous primary failed or handed over
+func (cm *CentralManager) takeOver(oldPrimaryId int) {
+	cm.lock.Lock()
+	cm.isPrimary = true
+	cm.primaryId = cm.Id
+	cm.epoch++
+	cm.acks = map[int]time.Time{}
+	epoch := cm.epoch
+	records := append([]*PageRecord{}, cm.PageRecords...)
+	cm.lock.Unlock()
+
+	cm.log().Info("Taking over as primary", "previous", oldPrimaryId, "epoch", epoch)
+	cm.inherit(records)
+}
+
+// inherit takes over the requests in flight for the pages that this CM did not start serving itself.
+// They are served again when their requester retries them, or once inheritTimeout has passed
+func (cm *CentralManager) inherit(records []*PageRecord) {
+	for _, pr := range records {
+		pr.lock.Lock()
+		pr.inherited = pr.inFlight != nil
+		pr.lock.Unlock()
+	}
+	spawn(cm.transport, func() {
+		<-after(cm.transport, inheritTimeout)
+		for _, pr := range records {
+			pr.lock.Lock()
+			request := pr.inFlight
+			inherited := pr.inherited
+			pr.inherited = false
+			pr.lock.Unlock()
+
+			if inherited {
+				cm.log().Info("Serving request left over from the previous primary", "page", request.PageNum, "requester", request.RequesterId)
+				spawn(cm.transport, func() { cm.serve(pr, request) })
+			}
+		}
+	})
+}
+
+// Status rpc returns whether this CM is the primary and which CM it thinks the primary is
+func (cm *CentralManager) Status(args *StatusArgs, res *StatusResponse) error {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+
+	res.CMId = cm.Id
+	res.IsPrimary = cm.isPrimary
+	res.PrimaryId = cm.primaryId
+	res.Epoch = cm.epoch
+	return nil
+}
+
+// Sync rpc called by a CM rejoining the cluster to fetch the primary's page table and queues
+func (cm *CentralManager) Sync(args *SyncArgs, res *SyncResponse) error {
+	if err := cm.checkPrimary(); err != nil {
+		return err
+	}
+	res.PrimaryId = cm.Id
+	res.Records = cm.states()
+	cm.lock.RLock()
+	res.Members, res.MembersVersion = cm.members()
+	cm.lock.RUnlock()
+	return nil
+}
+
+// HandOver rpc called by a backup CM that wants to become the primary. This CM steps down before
+// it collects its state, so the two CMs are never primary at the same time. Requests arriving in
+// between are turned away with errNotPrimary and retried by the nodes
+func (cm *CentralManager) HandOver(args *HandOverArgs, res *SyncResponse) error {
+	cm.lock.Lock()
+	if !cm.isPrimary {
+		cm.lock.Unlock()
+		return errNotPrimary
+	}
+	cm.isPrimary = false
+	cm.primaryId = args.CMId
+	// if the new primary never comes up, this CM takes over again once the heartbeats are missing
+	cm.lastHeartbeat = now(cm.transport)
+	cm.lock.Unlock()
+
+	cm.log().Info("Handing over the primary role", "successor", args.CMId)
+	res.PrimaryId = args.CMId
+	res.Records = cm.states()
+	cm.lock.RLock()
+	res.Members, res.MembersVersion = cm.members()
+	cm.lock.RUnlock()
+	return nil
+}
+
+// rejoin looks for a CM that is already acting as primary. If there is one, this CM becomes a backup
+// with the primary's state, and if reclaimPrimary is set it then asks the primary to hand over.
+// It reports whether another CM was primary
+func (cm *CentralManager) rejoin(reclaimPrimary bool) bool {
+	primaryId := -1
+	epoch := 0
+	for _, cmId := range cm.otherCMs() {
+		res := &StatusResponse{}
+		err := cm.transport.Call(cm.peers[cmId], "CentralManager.Status", &StatusArgs{}, res, replicateTimeout)
+		if err == nil && res.IsPrimary {
+			primaryId = cmId
+			epoch = res.Epoch
+			break
+		}
+	}
+	if primaryId == -1 {
+		return false
+	}
+
+	cm.lock.Lock()
+	cm.isPrimary = false
+	cm.primaryId = primaryId
+	cm.epoch = epoch
+	cm.lastHeartbeat = now(cm.transport)
+	cm.lock.Unlock()
+
+	res := &SyncResponse{}
+	err := cm.transport.Call(cm.peers[primaryId], "CentralManager.Sync", &SyncArgs{}, res, replicateTimeout)
+	if err != nil {
+		cm.log().Warn("Error syncing with the primary", "primary", primaryId, "err", err)
+		return true
+	}
+	cm.restore(res.Records)
+	cm.setMembers(res.Members, res.MembersVersion)
+	cm.log().Info("Rejoined as backup", "primary", primaryId, "pages", len(res.Records))
+
+	if !reclaimPrimary {
+		return true
+	}
+
+	res = &SyncResponse{}
+	err = cm.transport.Call(cm.peers[primaryId], "CentralManager.HandOver", &HandOverArgs{CMId: cm.Id}, res, replicateTimeout)
+	if err != nil {
+		cm.log().Warn("Error taking back the primary role", "primary", primaryId, "err", err)
+		return true
+	}
+	cm.restore(res.Records)
+	cm.setMembers(res.Members, res.MembersVersion)
+	cm.takeOver(primaryId)
+	return true
+}
@@ -0,0 +1,39 @@
+package ivy
+
+import "time"
+
+// scheduler is implemented by transports that also decide when goroutines run and when timers
+// fire, like Sim. Nodes and CMs start goroutines and wait through these helpers, which fall back
+// to the go statement and package time for any other transport.
+//
+// Under Sim only one goroutine of the cluster may run at a time, or the order in which they draw
+// from the random source and schedule events changes from run to run. A goroutine that lets
+// another one go on, by a send on a channel it waits on, does so through spawn, so that the
+// other goroutine is woken up by an event of its own
+type scheduler interface {
+	Go(f func())
+	After(d time.Duration) <-chan time.Time
+	Now() time.Time
+}
+
+func spawn(transport Transport, f func()) {
+	if s, ok := transport.(scheduler); ok {
+		s.Go(f)
+		return
+	}
+	go f()
+}
+
+func after(transport Transport, d time.Duration) <-chan time.Time {
+	if s, ok := transport.(scheduler); ok {
+		return s.After(d)
+	}
+	return time.After(d)
+}
+
+func now(transport Transport) time.Time {
+	if s, ok := transport.(scheduler); ok {
+		return s.Now()
+	}
+	return time.Now()
+}
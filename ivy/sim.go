@@ -0,0 +1,546 @@
+package ivy
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sim is a Transport that runs a whole cluster inside one process on a virtual clock. Message
+// deliveries, replies, timers and goroutine starts are all events, and only one event runs at a
+// time: the next one is started once every goroutine of the cluster is blocked again. A random
+// source seeded with the seed decides how long each message is delayed and whether it is lost,
+// so a run, and any failure in it, can be replayed exactly from its seed
+type Sim struct {
+	MaxDelay time.Duration // every message and reply is delayed by up to MaxDelay
+	LossRate float64       // fraction of messages and replies that are dropped
+	Trace    io.Writer     // every event is written here if not nil
+
+	lock      sync.Mutex
+	rng       *rand.Rand
+	now       time.Time
+	seq       int
+	steps     int
+	events    simEvents
+	endpoints map[string]*memEndpoint
+	calls     map[*memCall]bool // calls waiting for a reply
+	stopped   bool
+}
+
+type simEvent struct {
+	at   time.Time
+	seq  int
+	desc string
+	run  func()
+}
+
+// simEvents is a heap of events ordered by time, and by when they were scheduled for equal times
+type simEvents []*simEvent
+
+func (events simEvents) Len() int { return len(events) }
+func (events simEvents) Less(i, j int) bool {
+	if events[i].at.Equal(events[j].at) {
+		return events[i].seq < events[j].seq
+	}
+	return events[i].at.Before(events[j].at)
+}
+func (events simEvents) Swap(i, j int) { events[i], events[j] = events[j], events[i] }
+func (events *simEvents) Push(x any)   { *events = append(*events, x.(*simEvent)) }
+func (events *simEvents) Pop() any {
+	old := *events
+	event := old[len(old)-1]
+	*events = old[:len(old)-1]
+	return event
+}
+
+func NewSim(seed int64) *Sim {
+	return &Sim{
+		rng:       rand.New(rand.NewSource(seed)),
+		now:       time.Unix(0, 0),
+		endpoints: map[string]*memEndpoint{},
+		calls:     map[*memCall]bool{},
+	}
+}
+
+var errSimStopped = errors.New("simulation stopped")
+
+// schedule adds an event d after the current virtual time. sim.lock must be held
+func (sim *Sim) schedule(d time.Duration, desc string, run func()) {
+	if sim.stopped {
+		return
+	}
+	sim.seq++
+	heap.Push(&sim.events, &simEvent{at: sim.now.Add(d), seq: sim.seq, desc: desc, run: run})
+}
+
+// transmit schedules the arrival of a message, or drops it. sim.lock must be held
+func (sim *Sim) transmit(desc string, run func()) {
+	if sim.LossRate > 0 && sim.rng.Float64() < sim.LossRate {
+		sim.trace("lost " + desc)
+		return
+	}
+	var delay time.Duration
+	if sim.MaxDelay > 0 {
+		delay = time.Duration(sim.rng.Int63n(int64(sim.MaxDelay)))
+	}
+	sim.schedule(delay, desc, run)
+}
+
+func (sim *Sim) trace(msg string) {
+	if sim.Trace != nil {
+		fmt.Fprintf(sim.Trace, "[%d %s] %s\n", sim.steps, sim.now.Sub(time.Unix(0, 0)), msg)
+	}
+}
+
+// Intn returns a random number in [0, n) from the simulation's random source
+func (sim *Sim) Intn(n int) int {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return sim.rng.Intn(n)
+}
+
+func (sim *Sim) Serve(address string, services map[string]any) (io.Closer, error) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	if sim.endpoints[address] != nil {
+		return nil, fmt.Errorf("address %s already in use", address)
+	}
+	endpoint := &memEndpoint{services: services}
+	sim.endpoints[address] = endpoint
+	return &simListener{sim: sim, address: address, endpoint: endpoint}, nil
+}
+
+// Call sends the call as a message. The caller is blocked until the reply arrives, or until
+// timeout has passed in virtual time
+func (sim *Sim) Call(address string, method string, args any, reply any, timeout time.Duration) error {
+	encodedArgs, err := gobEncode(args)
+	if err != nil {
+		return err
+	}
+	call := &memCall{method: method, args: encodedArgs, done: make(chan memResult, 1)}
+
+	sim.lock.Lock()
+	if sim.stopped {
+		sim.lock.Unlock()
+		return errSimStopped
+	}
+	sim.calls[call] = true
+	desc := fmt.Sprintf("%s to %s", method, address)
+	sim.transmit(desc, func() { sim.deliver(address, call, desc) })
+	if timeout > 0 {
+		sim.schedule(timeout, "timeout of "+desc, func() {
+			select {
+			case call.done <- memResult{err: errors.New("timed out")}:
+			default:
+			}
+		})
+	}
+	sim.lock.Unlock()
+
+	result := <-call.done
+	sim.lock.Lock()
+	delete(sim.calls, call)
+	sim.lock.Unlock()
+	if result.err != nil {
+		return result.err
+	}
+	return gobDecode(result.reply, reply)
+}
+
+// deliver hands a call to its endpoint and sends the result back as another message
+func (sim *Sim) deliver(address string, call *memCall, desc string) {
+	sim.lock.Lock()
+	endpoint := sim.endpoints[address]
+	sim.lock.Unlock()
+
+	go func() {
+		var result memResult
+		if endpoint == nil {
+			result = memResult{err: fmt.Errorf("no endpoint listening on %s", address)}
+		} else {
+			result = endpoint.dispatch(call)
+		}
+
+		sim.lock.Lock()
+		sim.transmit("reply to "+desc, func() {
+			select {
+			case call.done <- result:
+			default:
+			}
+		})
+		sim.lock.Unlock()
+	}()
+}
+
+// Go starts f as the next event at the current virtual time. After Stop, f is not started
+func (sim *Sim) Go(f func()) {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	sim.schedule(0, "go", func() { go f() })
+}
+
+// After returns a channel that receives the virtual time once d has passed. After Stop, it never does
+func (sim *Sim) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	sim.schedule(d, "timer "+d.String(), func() { ch <- sim.Now() })
+	return ch
+}
+
+func (sim *Sim) Now() time.Time {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return sim.now
+}
+
+// Elapsed returns how much virtual time has passed since the simulation started
+func (sim *Sim) Elapsed() time.Duration {
+	return sim.Now().Sub(time.Unix(0, 0))
+}
+
+// Steps returns how many events have run
+func (sim *Sim) Steps() int {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return sim.steps
+}
+
+// Step runs the next event and waits until the cluster is blocked again. It returns false if
+// there are no events left
+func (sim *Sim) Step() bool {
+	sim.lock.Lock()
+	if len(sim.events) == 0 {
+		sim.lock.Unlock()
+		return false
+	}
+	event := heap.Pop(&sim.events).(*simEvent)
+	sim.now = event.at
+	sim.steps++
+	sim.trace(event.desc)
+	sim.lock.Unlock()
+
+	event.run()
+	sim.settle()
+	return true
+}
+
+// Stop ends the simulation. Calls waiting for a reply fail and no more events run, so that the
+// goroutines of the cluster can wind down
+func (sim *Sim) Stop() {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+
+	sim.stopped = true
+	sim.events = nil
+	for call := range sim.calls {
+		select {
+		case call.done <- memResult{err: errSimStopped}:
+		default:
+		}
+	}
+}
+
+// settle waits until no goroutine but the caller is running or runnable. All the goroutines of
+// the cluster are then blocked on a message, a timer or each other, and only the next event can
+// wake them up
+func (sim *Sim) settle() {
+	buf := make([]byte, 64*1024)
+	self := goroutineHeader(buf)
+	for {
+		n := runtime.Stack(buf, true)
+		if n == len(buf) {
+			buf = make([]byte, 2*len(buf))
+			continue
+		}
+		if !othersRunning(buf[:n], self) {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+// goroutineHeader returns the "goroutine N [" prefix of the calling goroutine's stack
+func goroutineHeader(buf []byte) []byte {
+	n := runtime.Stack(buf, false)
+	header := buf[:n]
+	if i := bytes.IndexByte(header, '['); i >= 0 {
+		header = header[:i+1]
+	}
+	return append([]byte{}, header...)
+}
+
+func othersRunning(stacks []byte, self []byte) bool {
+	for _, block := range bytes.Split(stacks, []byte("\n\n")) {
+		if bytes.HasPrefix(block, self) {
+			continue
+		}
+		start := bytes.IndexByte(block, '[')
+		end := bytes.IndexAny(block, ",]")
+		if start < 0 || end < start {
+			continue
+		}
+		switch string(block[start+1 : end]) {
+		case "running", "runnable", "syscall", "preempted", "semacquire", "GC assist wait":
+			// a goroutine waiting in semacquire or on the garbage collector is held up by the
+			// runtime, for instance by the stop the world of runtime.Stack, and goes on by itself
+			return true
+		}
+	}
+	return false
+}
+
+type simListener struct {
+	sim      *Sim
+	address  string
+	endpoint *memEndpoint
+}
+
+// Close stops delivering calls to the address, calls already delivered still complete
+func (listener *simListener) Close() error {
+	listener.sim.lock.Lock()
+	defer listener.sim.lock.Unlock()
+	if listener.sim.endpoints[listener.address] == listener.endpoint {
+		delete(listener.sim.endpoints, listener.address)
+	}
+	return nil
+}
+
+// SimConfig describes a simulated cluster and its workload. Every node runs OpsPerNode reads and
+// writes one after the other on random pages
+type SimConfig struct {
+	Seed       int64
+	Nodes      int
+	Pages      int
+	OpsPerNode int
+	WriteRatio float64 // fraction of operations that are writes
+	MaxDelay   time.Duration
+	LossRate   float64
+	MaxSteps   int
+	Trace      io.Writer
+	Manager    string // ManagerCentral runs one CM, ManagerFixed and ManagerDynamic have the nodes manage the pages
+	Policy     string // coherence policy of every page, PolicyInvalidate or PolicyUpdate
+}
+
+type SimResult struct {
+	Seed        int64
+	Steps       int
+	VirtualTime time.Duration
+	Ops         int // operations that completed
+	Failed      int // operations that returned an error, which only ends the run if no messages are lost
+	Err         error
+}
+
+// RunSim runs one CM and config.Nodes nodes under a Sim seeded with config.Seed. After every
+// event it checks that no page is writable on one node while another node holds a copy, and at
+// the end that every copy of a page has the same content and that the reads and writes of every
+// page are linearizable, under either policy. A run also fails if the cluster is stuck with
+// operations outstanding or goes over config.MaxSteps, or if an operation fails without any message
+// being lost. With lost messages an operation can fail once the retries run out, the history check
+// then allows for a failed write taking effect or not
+func RunSim(config SimConfig) SimResult {
+	sim := NewSim(config.Seed)
+	sim.MaxDelay = config.MaxDelay
+	sim.LossRate = config.LossRate
+	sim.Trace = config.Trace
+
+	nodeAddr := map[int]string{}
+	for i := 1; i <= config.Nodes; i++ {
+		nodeAddr[i] = "node" + strconv.Itoa(i)
+	}
+	CMaddr := map[int]string{0: "cm0"}
+
+	// pages start out spread over the nodes
+	pageRecords := []*PageRecord{}
+	nodePages := map[int][]*Page{}
+	initial := map[int]string{}
+	for p := 1; p <= config.Pages; p++ {
+		owner := 1 + (p-1)%config.Nodes
+		initial[p] = fmt.Sprintf("page %d", p)
+		pageRecords = append(pageRecords, &PageRecord{PageNum: p, CopySet: []int{}, Owner: owner, Policy: config.Policy})
+		nodePages[owner] = append(nodePages[owner], &Page{PageNum: p, Content: initial[p], Access: WRITE})
+	}
+
+	var cm *CentralManager
+	if !nodesManage(config.Manager) {
+		cm = NewCentralManager(0, 0, nodeAddr, pageRecords, CMaddr, 0, sim)
+	}
+	history := NewHistory()
+	managers := []int{}
+	for i := 1; i <= config.Nodes; i++ {
+		managers = append(managers, i)
+	}
+	nodes := []*Node{}
+	for i := 1; i <= config.Nodes; i++ {
+		node := NewNode(i, 0, CMaddr, nodeAddr, nodePages[i], sim)
+		if config.Manager == ManagerFixed {
+			node.ManagePages(managers, pageRecords)
+		} else if config.Manager == ManagerDynamic {
+			node.ManageDynamically(managers, pageRecords)
+		}
+		node.RecordHistory(history)
+		nodes = append(nodes, node)
+	}
+
+	result := SimResult{Seed: config.Seed}
+	if err := checkPolicy(config.Manager, config.Policy); err != nil {
+		result.Err = err
+		return result
+	}
+	var resultLock sync.Mutex
+	fail := func(err error) {
+		resultLock.Lock()
+		defer resultLock.Unlock()
+		if result.Err == nil {
+			result.Err = err
+		}
+	}
+
+	finished := 0
+	sim.Go(func() {
+		if cm != nil {
+			if err := cm.Start(false); err != nil {
+				fail(err)
+				return
+			}
+		}
+		for _, node := range nodes {
+			if err := node.Start(nodeAddr[node.Id]); err != nil {
+				fail(err)
+				return
+			}
+		}
+		for _, node := range nodes {
+			sim.Go(func() {
+				for i := 0; i < config.OpsPerNode; i++ {
+					err := simOp(sim, node, i, config)
+					resultLock.Lock()
+					if err == nil {
+						result.Ops++
+					} else {
+						result.Failed++
+					}
+					resultLock.Unlock()
+					if err != nil && config.LossRate == 0 {
+						fail(fmt.Errorf("node %d: %s", node.Id, err))
+					}
+				}
+				resultLock.Lock()
+				finished++
+				resultLock.Unlock()
+			})
+		}
+	})
+
+	for {
+		resultLock.Lock()
+		done := finished == len(nodes) || result.Err != nil
+		resultLock.Unlock()
+		if done {
+			break
+		}
+		if config.MaxSteps > 0 && sim.Steps() >= config.MaxSteps {
+			fail(fmt.Errorf("still running after %d steps, nodes may be stuck retrying", config.MaxSteps))
+			break
+		}
+		if !sim.Step() {
+			fail(fmt.Errorf("stuck with %d of %d nodes still working", len(nodes)-finished, len(nodes)))
+			break
+		}
+		if err := checkCoherence(nodes); err != nil {
+			fail(fmt.Errorf("after step %d: %s", sim.Steps(), err))
+		}
+	}
+	if result.Err == nil {
+		if err := checkCopies(nodes); err != nil {
+			fail(err)
+		}
+	}
+	if result.Err == nil {
+		results, _ := CheckHistory(history.Operations(), initial, Linearizable)
+		for _, pageResult := range results {
+			if !pageResult.Ok {
+				fail(fmt.Errorf("history is not %s, %s", Linearizable, pageResult))
+				break
+			}
+		}
+	}
+
+	sim.Stop()
+	if cm != nil {
+		cm.Close()
+	}
+	for _, node := range nodes {
+		node.Close()
+	}
+
+	result.Steps = sim.Steps()
+	result.VirtualTime = sim.Elapsed()
+	return result
+}
+
+// simOp runs the i-th operation of a node after a short pause
+func simOp(sim *Sim, node *Node, i int, config SimConfig) error {
+	<-sim.After(time.Duration(sim.Intn(100)) * time.Millisecond)
+
+	pageNum := 1 + sim.Intn(config.Pages)
+	if float64(sim.Intn(1000)) < config.WriteRatio*1000 {
+		return node.WritePage(context.Background(), pageNum, []byte(fmt.Sprintf("node %d write %d", node.Id, i)))
+	}
+	_, err := node.ReadPage(context.Background(), pageNum)
+	return err
+}
+
+// checkCoherence checks that a page writable on one node is not cached anywhere else
+func checkCoherence(nodes []*Node) error {
+	writers := map[int][]int{}
+	readers := map[int][]int{}
+	for _, node := range nodes {
+		node.lock.Lock()
+		for _, page := range node.Pages {
+			if page.Access == WRITE {
+				writers[page.PageNum] = append(writers[page.PageNum], node.Id)
+			} else if page.Access == READ {
+				readers[page.PageNum] = append(readers[page.PageNum], node.Id)
+			}
+		}
+		node.lock.Unlock()
+	}
+	for pageNum, writerIds := range writers {
+		if len(writerIds) > 1 || len(readers[pageNum]) > 0 {
+			return fmt.Errorf("page %d is writable on nodes %v while nodes %v have read copies", pageNum, writerIds, readers[pageNum])
+		}
+	}
+	return nil
+}
+
+// checkCopies checks that every cached copy of a page has the same content
+func checkCopies(nodes []*Node) error {
+	contents := map[int]string{}
+	holders := map[int]int{}
+	for _, node := range nodes {
+		node.lock.Lock()
+		for _, page := range node.Pages {
+			if page.Access != READ && page.Access != WRITE {
+				continue
+			}
+			if holder, ok := holders[page.PageNum]; ok && contents[page.PageNum] != page.Content {
+				node.lock.Unlock()
+				return fmt.Errorf("page %d is %q on node %d but %q on node %d", page.PageNum, page.Content, node.Id, contents[page.PageNum], holder)
+			}
+			holders[page.PageNum] = node.Id
+			contents[page.PageNum] = page.Content
+		}
+		node.lock.Unlock()
+	}
+	return nil
+}
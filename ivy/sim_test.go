@@ -0,0 +1,103 @@
+package ivy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func simConfig(seed int64, manager string, policy string, loss float64) SimConfig {
+	return SimConfig{
+		Seed:       seed,
+		Nodes:      3,
+		Pages:      2,
+		OpsPerNode: 20,
+		WriteRatio: 0.5,
+		MaxDelay:   50 * time.Millisecond,
+		LossRate:   loss,
+		MaxSteps:   100000,
+		Manager:    manager,
+		Policy:     policy,
+	}
+}
+
+func TestSimSeeds(t *testing.T) {
+	tests := []struct {
+		name    string
+		manager string
+		policy  string
+		loss    float64
+	}{
+		{name: "central", manager: ManagerCentral},
+		{name: "fixed", manager: ManagerFixed},
+		{name: "dynamic", manager: ManagerDynamic},
+		{name: "central update", manager: ManagerCentral, policy: PolicyUpdate},
+		{name: "fixed update", manager: ManagerFixed, policy: PolicyUpdate},
+		{name: "central loss", manager: ManagerCentral, loss: 0.05},
+		{name: "fixed loss", manager: ManagerFixed, loss: 0.05},
+		{name: "dynamic loss", manager: ManagerDynamic, loss: 0.05},
+		{name: "central update loss", manager: ManagerCentral, policy: PolicyUpdate, loss: 0.05},
+		{name: "central heavy loss", manager: ManagerCentral, loss: 0.1},
+		{name: "dynamic heavy loss", manager: ManagerDynamic, loss: 0.1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for seed := int64(1); seed <= 10; seed++ {
+				result := RunSim(simConfig(seed, test.manager, test.policy, test.loss))
+				if result.Err != nil {
+					t.Errorf("seed %d: %v", seed, result.Err)
+				}
+			}
+		})
+	}
+}
+
+// a run is replayed exactly from its seed, event for event
+func TestSimReplay(t *testing.T) {
+	tests := []struct {
+		name    string
+		manager string
+		policy  string
+		loss    float64
+	}{
+		{name: "central", manager: ManagerCentral},
+		{name: "fixed", manager: ManagerFixed},
+		{name: "dynamic", manager: ManagerDynamic},
+		{name: "central update", manager: ManagerCentral, policy: PolicyUpdate},
+		{name: "fixed update", manager: ManagerFixed, policy: PolicyUpdate},
+		{name: "central loss", manager: ManagerCentral, loss: 0.05},
+		{name: "dynamic loss", manager: ManagerDynamic, loss: 0.05},
+		{name: "central update loss", manager: ManagerCentral, policy: PolicyUpdate, loss: 0.05},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, seed := range []int64{3, 7, 11} {
+				traces := []string{}
+				for range 2 {
+					var trace bytes.Buffer
+					config := simConfig(seed, test.manager, test.policy, test.loss)
+					config.Trace = &trace
+					if result := RunSim(config); result.Err != nil {
+						t.Fatalf("seed %d: %v", seed, result.Err)
+					}
+					traces = append(traces, trace.String())
+				}
+				if traces[0] != traces[1] {
+					t.Fatalf("seed %d: the second run differs from the first after %d lines of trace", seed, firstDifference(traces[0], traces[1]))
+				}
+			}
+		})
+	}
+}
+
+// firstDifference returns the number of trace lines two traces have in common
+func firstDifference(first string, second string) int {
+	firstLines := strings.Split(first, "\n")
+	secondLines := strings.Split(second, "\n")
+	i := 0
+	for i < len(firstLines) && i < len(secondLines) && firstLines[i] == secondLines[i] {
+		i++
+	}
+	return i
+}
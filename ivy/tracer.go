@@ -0,0 +1,175 @@
+package ivy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Tracer records spans in the Chrome trace event format, which chrome://tracing and ui.perfetto.dev
+// show as a timeline. Every process writes its own file, `ivy trace` merges the files of a run so
+// that all the hops of a request show up side by side. A span carries the id of the request it
+// belongs to, and is drawn in the lane of the node that made the request
+type Tracer struct {
+	lock   sync.Mutex
+	file   *os.File
+	pid    int
+	events int
+}
+
+// traceEvent is one entry of a Chrome trace. Complete events ("X") have a start and a duration,
+// metadata events ("M") name the process
+type traceEvent struct {
+	Name  string         `json:"name"`
+	Phase string         `json:"ph"`
+	Ts    int64          `json:"ts"` // microseconds
+	Dur   int64          `json:"dur"`
+	Pid   int            `json:"pid"`
+	Tid   int            `json:"tid"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+// pids of the processes in a trace: nodes use their id, CMs 1000 plus their id
+const cmTracePid = 1000
+
+// OpenTracer creates the trace file at path for the process with the given pid and name
+func OpenTracer(path string, pid int, processName string) (*Tracer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	tracer := &Tracer{file: file, pid: pid}
+	// the closing bracket is optional in the format, so a trace cut off by a crash still loads
+	if _, err := file.WriteString("["); err != nil {
+		file.Close()
+		return nil, err
+	}
+	tracer.write(traceEvent{Name: "process_name", Phase: "M", Pid: pid, Args: map[string]any{"name": processName}})
+	return tracer, nil
+}
+
+func (tracer *Tracer) write(event traceEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+
+	if tracer.events > 0 {
+		data = append([]byte(",\n"), data...)
+	} else {
+		data = append([]byte("\n"), data...)
+	}
+	if _, err := tracer.file.Write(data); err != nil {
+		logger.Error("Error writing trace", "file", tracer.file.Name(), "err", err)
+		return
+	}
+	tracer.events++
+}
+
+// record writes a span that ran from start to end
+func (tracer *Tracer) record(name string, requestId string, pageNum int, requesterId int, start time.Time, end time.Time) {
+	tracer.write(traceEvent{
+		Name:  name,
+		Phase: "X",
+		Ts:    start.UnixMicro(),
+		Dur:   end.Sub(start).Microseconds(),
+		Pid:   tracer.pid,
+		Tid:   requesterId,
+		Args:  map[string]any{"request": requestId, "page": pageNum},
+	})
+}
+
+// Close ends the trace and closes its file
+func (tracer *Tracer) Close() error {
+	tracer.lock.Lock()
+	defer tracer.lock.Unlock()
+
+	if _, err := tracer.file.WriteString("\n]\n"); err != nil {
+		tracer.file.Close()
+		return err
+	}
+	return tracer.file.Close()
+}
+
+// MergeTraces reads the trace files of several processes and returns them as one trace
+func MergeTraces(paths []string) ([]byte, error) {
+	events := []json.RawMessage{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data = bytes.TrimSpace(data)
+		if !bytes.HasSuffix(data, []byte("]")) {
+			// the process did not close its trace
+			data = append(bytes.TrimSuffix(data, []byte(",")), ']')
+		}
+		fileEvents := []json.RawMessage{}
+		if err := json.Unmarshal(data, &fileEvents); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		events = append(events, fileEvents...)
+	}
+	return json.MarshalIndent(events, "", " ")
+}
+
+// OpenTrace makes the CM record a span for every hop of a request it handles in a trace file at path
+func (cm *CentralManager) OpenTrace(path string) error {
+	tracer, err := OpenTracer(path, cmTracePid+cm.Id, fmt.Sprintf("cm %d", cm.Id))
+	if err != nil {
+		return err
+	}
+	cm.tracer = tracer
+	return nil
+}
+
+// span starts a span of the CM and returns the function that ends it
+func (cm *CentralManager) span(name string, requestId string, pageNum int, requesterId int) func() {
+	if cm.tracer == nil {
+		return func() {}
+	}
+	start := now(cm.transport)
+	return func() {
+		cm.tracer.record(name, requestId, pageNum, requesterId, start, now(cm.transport))
+	}
+}
+
+// OpenTrace makes the node record a span for every hop of a request it handles in a trace file at path.
+// It must be called after the node has its id, see Join, and before Start
+func (node *Node) OpenTrace(path string) error {
+	tracer, err := OpenTracer(path, node.Id, fmt.Sprintf("node %d", node.Id))
+	if err != nil {
+		return err
+	}
+	node.tracer = tracer
+	if node.manager != nil {
+		node.manager.tracer = tracer
+	}
+	return nil
+}
+
+// spanSince records a span of the node for a request of its own that ran from start until now.
+// Unlike span it reads the request id at the end, as the id is only made when the request is sent
+func (node *Node) spanSince(name string, request *Request, start time.Time) {
+	if node.tracer == nil {
+		return
+	}
+	node.tracer.record(name, request.Id, request.PageNum, node.Id, start, now(node.transport))
+}
+
+// span starts a span of the node and returns the function that ends it
+func (node *Node) span(name string, requestId string, pageNum int, requesterId int) func() {
+	if node.tracer == nil {
+		return func() {}
+	}
+	start := now(node.transport)
+	return func() {
+		node.tracer.record(name, requestId, pageNum, requesterId, start, now(node.transport))
+	}
+}
@@ -0,0 +1,126 @@
+package ivy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Transport carries the RPC calls between nodes and CMs
+type Transport interface {
+	// Serve delivers the calls made to address to services, keyed by the receiver name used
+	// in method names, e.g. "Node" for "Node.SendPage". Closing the result stops serving
+	Serve(address string, services map[string]any) (io.Closer, error)
+
+	// Call makes an RPC call to address. A timeout of 0 waits for as long as the call takes.
+	// An error returned by the remote method comes back as an rpc.ServerError
+	Call(address string, method string, args any, reply any, timeout time.Duration) error
+}
+
+// TCPTransport is the Transport used between processes, net/rpc over TCP with one
+// persistent connection per peer
+type TCPTransport struct {
+	clients *clientPool
+}
+
+func NewTCPTransport() *TCPTransport {
+	return &TCPTransport{clients: newClientPool()}
+}
+
+func (transport *TCPTransport) Serve(address string, services map[string]any) (io.Closer, error) {
+	// every endpoint gets its own server instead of the global rpc registry, so that
+	// several nodes can be served from the same process
+	server := rpc.NewServer()
+	for name, service := range services {
+		err := server.RegisterName(name, service)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	tcp := &tcpListener{listener: listener, conns: map[net.Conn]bool{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				logger.Error("Error accepting", "address", address, "err", err)
+				continue
+			}
+			if !tcp.add(conn) {
+				conn.Close()
+				return
+			}
+			go func() {
+				server.ServeConn(conn)
+				tcp.remove(conn)
+			}()
+		}
+	}()
+	return tcp, nil
+}
+
+// tcpListener is what Serve returns for TCP, it keeps the connections accepted on the
+// listener so that closing it stops serving them too
+type tcpListener struct {
+	listener net.Listener
+	lock     sync.Mutex
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+// add keeps conn, it reports false if the listener has been closed in the meantime
+func (tcp *tcpListener) add(conn net.Conn) bool {
+	tcp.lock.Lock()
+	defer tcp.lock.Unlock()
+
+	if tcp.closed {
+		return false
+	}
+	tcp.conns[conn] = true
+	return true
+}
+
+func (tcp *tcpListener) remove(conn net.Conn) {
+	tcp.lock.Lock()
+	defer tcp.lock.Unlock()
+
+	delete(tcp.conns, conn)
+}
+
+// Close stops accepting connections and closes the ones accepted, the peers' calls on them fail.
+// Calls already being handled still run, but their replies are not sent
+func (tcp *tcpListener) Close() error {
+	tcp.lock.Lock()
+	tcp.closed = true
+	conns := tcp.conns
+	tcp.conns = map[net.Conn]bool{}
+	tcp.lock.Unlock()
+
+	err := tcp.listener.Close()
+	for conn := range conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (transport *TCPTransport) Call(address string, method string, args any, reply any, timeout time.Duration) error {
+	return transport.clients.call(address, method, args, reply, timeout)
+}
+
+// Close closes the connections to every peer, which also ends the peers' side of them. The
+// listeners returned by Serve, and the connections they accepted, are closed on their own
+func (transport *TCPTransport) Close() error {
+	transport.clients.close()
+	return nil
+}
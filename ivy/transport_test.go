@@ -0,0 +1,33 @@
+package ivy
+
+import (
+	"testing"
+	"time"
+)
+
+type echoService struct{}
+
+func (echoService) Echo(args *string, res *string) error {
+	*res = *args
+	return nil
+}
+
+// closing what Serve returned also stops serving the connections that are already open
+func TestTCPCloseStopsServing(t *testing.T) {
+	transport := NewTCPTransport()
+	defer transport.Close()
+	closer, err := transport.Serve("127.0.0.1:0", map[string]any{"Echo": echoService{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := closer.(*tcpListener).listener.Addr().String()
+
+	args, res := "hello", ""
+	if err := transport.Call(address, "Echo.Echo", &args, &res, time.Second); err != nil || res != args {
+		t.Fatalf("call before Close: %q, %v", res, err)
+	}
+	closer.Close()
+	if err := transport.Call(address, "Echo.Echo", &args, &res, time.Second); err == nil {
+		t.Fatal("call on the open connection was served after Close")
+	}
+}
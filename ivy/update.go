@@ -0,0 +1,299 @@
+package ivy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// coherence policies of a page, see PageRecord.Policy. Under write-invalidate a writer takes the
+// only copy of the page, so every reader faults again after a write. Under write-update the copies
+// stay where they are and every write is pushed to all of them, which costs one message per copy
+// on every write but no read faults
+const (
+	PolicyInvalidate = "invalidate" // the default
+	PolicyUpdate     = "update"
+)
+
+// checkPolicy checks that a page policy is known and can be used with a manager mode. Updates are
+// put in order by a page manager, so there is none under the dynamic distributed manager
+func checkPolicy(manager string, policy string) error {
+	if policy != "" && policy != PolicyInvalidate && policy != PolicyUpdate {
+		return fmt.Errorf("unknown policy %q, expected %s or %s", policy, PolicyInvalidate, PolicyUpdate)
+	}
+	if policy == PolicyUpdate && manager == ManagerDynamic {
+		return fmt.Errorf("the %s policy needs a page manager, it cannot be used with the %s manager", PolicyUpdate, ManagerDynamic)
+	}
+	return nil
+}
+
+// how long the CM waits for each node to acknowledge an update
+const updateTimeout = 2 * time.Second
+
+// SetPolicy rpc changes the coherence policy of a page. A write that is being served finishes under
+// the old policy, the copies are valid under both
+func (cm *CentralManager) SetPolicy(args *SetPolicyArgs, res *SetPolicyResponse) error {
+	if err := cm.checkPrimary(); err != nil {
+		return err
+	}
+	if args.Policy == "" {
+		return fmt.Errorf("no policy given, expected %s or %s", PolicyInvalidate, PolicyUpdate)
+	}
+	if err := checkPolicy("", args.Policy); err != nil {
+		return err
+	}
+	pr := cm.findPageRecord(args.PageNum)
+	if pr == nil {
+		return errors.New("page not found")
+	}
+
+	pr.lock.Lock()
+	if pr.freed {
+		pr.lock.Unlock()
+		return errors.New("page not found")
+	}
+	pr.Policy = args.Policy
+	state, err := cm.snapshot(pr)
+	pr.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := cm.replicate(state); err != nil {
+		return err
+	}
+
+	cm.log().Info("Changed policy", "page", args.PageNum, "policy", args.Policy)
+	return nil
+}
+
+// serveUpdate applies a write to a page with the update policy. Nobody gets write access: the new
+// content goes to the owner and every copy holder in two phases. First every holder prepares the
+// update and stops reading its copy. Once they all have, the update is recorded as applied and
+// every holder gets the new content, the writer, which keeps a copy, last. No copy is read with the
+// old content after another one has the new, so the writes are linearizable as under invalidate.
+// If a holder does not prepare the update is aborted and the write fails. A holder that misses the
+// end of an update faults on its next read, and the owner settles it when the next request is
+// forwarded to it, see Node.settleUpdate. The CM serves the writes of a page one at a time, which
+// puts them in one total order, and numbers them so that an update that arrives late, like the
+// writer's own behind the next write, is not applied over a newer one
+func (cm *CentralManager) serveUpdate(pr *PageRecord, request *Request) error {
+	pr.lock.Lock()
+	pr.updates++
+	update := &UpdatePageArgs{PageNum: request.PageNum, Content: request.Content, Seq: pr.updates, OwnerId: pr.Owner, RequesterId: request.RequesterId, RequestId: request.Id}
+	holders := []int{pr.Owner}
+	for _, nodeId := range pr.CopySet {
+		if !containsNode(holders, nodeId) {
+			holders = append(holders, nodeId)
+		}
+	}
+	state, err := cm.snapshot(pr)
+	pr.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := cm.replicate(state); err != nil {
+		return err
+	}
+
+	others := removeNode(holders, request.RequesterId)
+	cm.metrics.updatesPerOp.observe(float64(len(others) + 1))
+	prepare := *update
+	prepare.Prepare = true
+	if err := cm.updateCopies(&prepare, holders); err != nil {
+		return cm.abortUpdate(request, update, others, err)
+	}
+
+	// the update goes through from here on, also at a CM that takes over
+	pr.lock.Lock()
+	pr.applied = update.Seq
+	state, err = cm.snapshot(pr)
+	pr.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := cm.replicate(state); err != nil {
+		return err
+	}
+	if err := cm.updateCopies(update, others); err != nil {
+		cm.log().Warn("Copies missed an update, they fault on their next read", "page", request.PageNum, "seq", update.Seq, "err", err)
+	}
+	// completed before the writer hears of it, like a WriteConfirm, so that the writer's next
+	// request is not taken for this one sent again
+	err = cm.complete(request.PageNum, request.RequesterId, request.Id, nil, func(pr *PageRecord) {
+		if pr.Owner != request.RequesterId && !containsNode(pr.CopySet, request.RequesterId) {
+			pr.AddCopy(request.RequesterId)
+		}
+		// a copy of the request that comes after the writer missed the update below is answered
+		// with the update, and not applied again over the writes after it
+		served := pr.findServed(request.RequesterId, request.Id)
+		served.Seq = update.Seq
+		served.Content = update.Content
+		cm.log().Info("Page record updated", "page", pr.PageNum, "owner", pr.Owner, "copyset", pr.CopySet)
+	})
+	if err != nil {
+		return err
+	}
+	if err := cm.sendUpdate(request.RequesterId, update); err != nil {
+		// the write has taken effect, a writer that is still waiting sends its request again and
+		// gets the update then
+		cm.log().Warn("Update to the writer failed", "page", request.PageNum, "requester", request.RequesterId, "err", err)
+	}
+	return nil
+}
+
+// abortUpdate lets the holders of a page read their copies again after an update that not all of
+// them prepared, and fails the write with reason
+func (cm *CentralManager) abortUpdate(request *Request, update *UpdatePageArgs, others []int, reason error) error {
+	abort := *update
+	abort.Abort = true
+	abort.Reason = reason.Error()
+	if err := cm.updateCopies(&abort, others); err != nil {
+		// they fault on their next read, and the owner drops the update when the next request gets to it
+		cm.log().Warn("Copies missed the abort of an update", "page", request.PageNum, "seq", update.Seq, "err", err)
+	}
+	if err := cm.complete(request.PageNum, request.RequesterId, request.Id, reason, nil); err != nil {
+		return err
+	}
+	if err := cm.sendUpdate(request.RequesterId, &abort); err != nil {
+		// a writer that is still waiting sends its request again and gets the error then
+		cm.log().Warn("Abort to the writer failed", "page", request.PageNum, "requester", request.RequesterId, "err", err)
+	}
+	return nil
+}
+
+// updateCopies sends an update to every node in holders at the same time and waits for all of them.
+// It returns an error listing the nodes that did not acknowledge
+func (cm *CentralManager) updateCopies(update *UpdatePageArgs, holders []int) error {
+	errs := make([]error, len(holders))
+	var wg sync.WaitGroup
+	for i, nodeId := range holders {
+		wg.Add(1)
+		spawn(cm.transport, func() {
+			defer wg.Done()
+			errs[i] = cm.sendUpdate(nodeId, update)
+		})
+	}
+	wg.Wait()
+
+	failed := []int{}
+	for i, nodeId := range holders {
+		if errs[i] != nil {
+			cm.log().Warn("Update failed", "page", update.PageNum, "to", nodeId, "err", errs[i])
+			cm.metrics.updatesFailed.inc()
+			failed = append(failed, nodeId)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("update of page %d not acknowledged by nodes %v", update.PageNum, failed)
+	}
+	return nil
+}
+
+// sendUpdate pushes a write to one node. Each try gives up after updateTimeout, and the node is tried
+// sendAttempts times, it applies an update only once
+func (cm *CentralManager) sendUpdate(nodeId int, update *UpdatePageArgs) error {
+	defer cm.span("UpdatePage", update.RequestId, update.PageNum, update.RequesterId)()
+	res := &UpdatePageResponse{}
+	var err error
+	for attempt := 0; attempt < sendAttempts; attempt++ {
+		req := *update
+		req.Clock = cm.clock.tick()
+		cm.metrics.updates.inc()
+		cm.log().Info("Sending update", "page", update.PageNum, "to", nodeId, "seq", update.Seq, "request", update.RequestId, "clock", req.Clock)
+		err = cm.transport.Call(cm.nodeAddress(nodeId), "Node.UpdatePage", &req, res, updateTimeout)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	cm.clock.witness(res.Clock)
+	return nil
+}
+
+// UpdatePage is a RPC method that is called by the CM to prepare, apply or abort a write to this
+// node's copy of a page with the update policy, see serveUpdate. For the writer the update or its
+// abort also ends the write
+func (node *Node) UpdatePage(args *UpdatePageArgs, res *UpdatePageResponse) error {
+	clock := node.clock.witness(args.Clock)
+	node.metrics.updates.inc()
+	defer node.span("UpdatePage", args.RequestId, args.PageNum, args.RequesterId)()
+	defer func() { res.Clock = node.clock.tick() }()
+
+	node.lock.Lock()
+	if args.Prepare {
+		if args.Seq > node.updateSeq[args.PageNum] {
+			prepared := *args
+			node.prepared[args.PageNum] = &prepared
+			if page := node.findPage(args.PageNum); page != nil && page.Access == READ {
+				page.Access = updating
+			}
+			node.log().Info("Prepared update", "page", args.PageNum, "seq", args.Seq, "requester", args.RequesterId, "request", args.RequestId, "clock", clock)
+		}
+		node.lock.Unlock()
+		return nil
+	}
+	if args.Abort {
+		node.dropUpdate(args.PageNum, args.Seq)
+	} else if args.Seq > node.updateSeq[args.PageNum] {
+		node.updateSeq[args.PageNum] = args.Seq
+		prepared := node.prepared[args.PageNum]
+		page := node.installPage(args.PageNum, args.Content, READ)
+		if prepared != nil && prepared.Seq > args.Seq {
+			// sent again after the next update was prepared, the copy waits for that one
+			node.prepared[args.PageNum] = prepared
+			page.Access = updating
+		}
+		if args.OwnerId == node.Id {
+			node.persist(page)
+		}
+		node.log().Info("Applied update", "page", args.PageNum, "seq", args.Seq, "requester", args.RequesterId, "request", args.RequestId, "clock", clock)
+	}
+	request := node.currentRequest
+	if args.RequesterId != node.Id || request == nil || request.Id != args.RequestId || request.TypeOfReq != WRITE {
+		node.lock.Unlock()
+		return nil
+	}
+	node.currentRequest = nil
+	node.lock.Unlock()
+
+	spawn(node.transport, func() {
+		if args.Reason != "" {
+			request.done <- errors.New(args.Reason)
+		} else {
+			request.done <- nil
+		}
+	})
+	return nil
+}
+
+// dropUpdate forgets the update with seq that the node prepared for a page, and reads its copy
+// as it was. node.lock must be held
+func (node *Node) dropUpdate(pageNum int, seq int) {
+	prepared := node.prepared[pageNum]
+	if prepared == nil || prepared.Seq != seq {
+		return
+	}
+	delete(node.prepared, pageNum)
+	if page := node.findPage(pageNum); page != nil && page.Access == updating {
+		page.Access = READ
+	}
+}
+
+// settleUpdate ends an update that the owner of a page prepared and never heard the end of, before
+// the page is sent on. applied is the last update of the page that went through. node.lock must be held
+func (node *Node) settleUpdate(pageNum int, applied int) {
+	prepared := node.prepared[pageNum]
+	if prepared == nil {
+		return
+	}
+	if prepared.Seq > applied {
+		node.dropUpdate(pageNum, prepared.Seq)
+		return
+	}
+	node.log().Info("Applied prepared update", "page", pageNum, "seq", prepared.Seq)
+	node.updateSeq[pageNum] = prepared.Seq
+	node.persist(node.installPage(pageNum, prepared.Content, READ))
+}
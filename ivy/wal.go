@@ -0,0 +1,374 @@
+package ivy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	walLogFile      = "wal.log"
+	walSnapshotFile = "snapshot.json"
+	walCompactEvery = 1000 // entries appended to the log before it is compacted into the snapshot
+)
+
+// walEntry is one line of the log, either the new state of a page record or a new membership
+type walEntry struct {
+	Record         *PageRecordState `json:",omitempty"`
+	Members        map[int]string   `json:",omitempty"`
+	MembersVersion int              `json:",omitempty"`
+}
+
+// walSnapshot is the state that the snapshot file and the log add up to
+type walSnapshot struct {
+	Records        []PageRecordState
+	Members        map[int]string
+	MembersVersion int
+}
+
+// WAL is the write-ahead log of a CM. Every change to a page record or to the membership is appended
+// and synced to disk before the CM acts on it, so a CM that restarts comes back with the page table
+// and queues it had. Every walCompactEvery entries the log is folded into a snapshot and emptied
+type WAL struct {
+	lock    sync.Mutex
+	dir     string
+	file    *os.File
+	entries int // entries in the log since the last snapshot
+
+	// what the snapshot and the log add up to, written out as the next snapshot
+	records        map[int]PageRecordState
+	members        map[int]string
+	membersVersion int
+}
+
+// OpenWAL opens the log in dir, creating dir if needed, and replays it. created reports whether
+// there was no log yet, in which case the CM starts from its configured state instead
+func OpenWAL(dir string) (wal *WAL, created bool, err error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, false, err
+	}
+	wal = &WAL{dir: dir, records: map[int]PageRecordState{}, members: map[int]string{}}
+
+	snapshot, err := readWALSnapshot(filepath.Join(dir, walSnapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		created = true
+	} else if err != nil {
+		return nil, false, err
+	} else {
+		for _, state := range snapshot.Records {
+			wal.records[state.PageNum] = state
+		}
+		wal.members = snapshot.Members
+		wal.membersVersion = snapshot.MembersVersion
+	}
+
+	wal.file, err = os.OpenFile(filepath.Join(dir, walLogFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := wal.replay(); err != nil {
+		wal.file.Close()
+		return nil, false, err
+	}
+	if wal.entries > 0 {
+		created = false
+	}
+	return wal, created, nil
+}
+
+func readWALSnapshot(path string) (*walSnapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &walSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return snapshot, nil
+}
+
+// replay applies every entry in the log. A last line without a newline was cut off by a crash
+// before it was synced, so nothing acted on it and it is cut from the log
+func (wal *WAL) replay() error {
+	reader := bufio.NewReader(wal.file)
+	var good int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		entry := walEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("%s: entry at offset %d: %w", walLogFile, good, err)
+		}
+		wal.apply(entry)
+		wal.entries++
+		good += int64(len(line))
+	}
+
+	info, err := wal.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > good {
+		logger.Warn("Dropping an unfinished entry at the end of the write-ahead log", "dir", wal.dir, "bytes", info.Size()-good)
+		return wal.file.Truncate(good)
+	}
+	return nil
+}
+
+// apply folds an entry into the state the log adds up to. A freed page is forgotten, so its page
+// number can be used again by a later allocation
+func (wal *WAL) apply(entry walEntry) {
+	if entry.Record == nil {
+		if entry.MembersVersion > wal.membersVersion {
+			wal.members = entry.Members
+			wal.membersVersion = entry.MembersVersion
+		}
+		return
+	}
+
+	state := *entry.Record
+	if state.Freed {
+		delete(wal.records, state.PageNum)
+		return
+	}
+	if old, ok := wal.records[state.PageNum]; ok && state.Version <= old.Version {
+		return
+	}
+	wal.records[state.PageNum] = state
+}
+
+// Append writes an entry to the log and syncs it, compacting the log when it has grown long enough
+func (wal *WAL) Append(entry walEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	if _, err := wal.file.Write(data); err != nil {
+		return err
+	}
+	if err := wal.file.Sync(); err != nil {
+		return err
+	}
+	wal.apply(entry)
+	wal.entries++
+
+	if wal.entries >= walCompactEvery {
+		return wal.compact()
+	}
+	return nil
+}
+
+// Reset replaces everything in the log with snapshot
+func (wal *WAL) Reset(snapshot walSnapshot) error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	wal.records = map[int]PageRecordState{}
+	for _, state := range snapshot.Records {
+		wal.records[state.PageNum] = state
+	}
+	wal.members = snapshot.Members
+	wal.membersVersion = snapshot.MembersVersion
+	return wal.compact()
+}
+
+// State returns what the snapshot and the log add up to, with the records in page order
+func (wal *WAL) State() walSnapshot {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	return wal.state()
+}
+
+// state is State with wal.lock held
+func (wal *WAL) state() walSnapshot {
+	snapshot := walSnapshot{Records: []PageRecordState{}, Members: map[int]string{}, MembersVersion: wal.membersVersion}
+	for _, state := range wal.records {
+		snapshot.Records = append(snapshot.Records, state)
+	}
+	sort.Slice(snapshot.Records, func(i, j int) bool { return snapshot.Records[i].PageNum < snapshot.Records[j].PageNum })
+	for id, address := range wal.members {
+		snapshot.Members[id] = address
+	}
+	return snapshot
+}
+
+// compact writes the current state to a new snapshot and then empties the log. If the CM crashes
+// in between, the log is replayed over the new snapshot, which changes nothing as the snapshot
+// already has newer versions of every entry. wal.lock must be held
+func (wal *WAL) compact() error {
+	data, err := json.MarshalIndent(wal.state(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(wal.dir, "snapshot-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once the file has been renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(wal.dir, walSnapshotFile)); err != nil {
+		return err
+	}
+	dir, err := os.Open(wal.dir)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := wal.file.Sync(); err != nil {
+		return err
+	}
+	wal.entries = 0
+	return nil
+}
+
+// Close closes the log file
+func (wal *WAL) Close() error {
+	wal.lock.Lock()
+	defer wal.lock.Unlock()
+
+	return wal.file.Close()
+}
+
+// OpenWAL makes the CM log every change to its page table and membership in dir. A new log starts
+// out with the CM's current state, an existing one replaces that state with the one in the log.
+// It must be called before Start
+func (cm *CentralManager) OpenWAL(dir string) error {
+	wal, created, err := OpenWAL(dir)
+	if err != nil {
+		return err
+	}
+
+	if created {
+		cm.lock.RLock()
+		members, version := cm.members()
+		cm.lock.RUnlock()
+		err := wal.Reset(walSnapshot{Records: cm.states(), Members: members, MembersVersion: version})
+		if err != nil {
+			wal.Close()
+			return err
+		}
+		cm.wal = wal
+		return nil
+	}
+
+	snapshot := wal.State()
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+
+	cm.PageRecords = []*PageRecord{}
+	cm.records = map[int]*PageRecord{}
+	for _, state := range snapshot.Records {
+		pr := &PageRecord{
+			PageNum:  state.PageNum,
+			CopySet:  state.CopySet,
+			Owner:    state.Owner,
+			Policy:   state.Policy,
+			updates:  state.Updates,
+			applied:  state.Applied,
+			served:   state.Served,
+			inFlight: state.InFlight,
+			queue:    state.Queue,
+			version:  state.Version,
+		}
+		cm.PageRecords = append(cm.PageRecords, pr)
+		cm.records[pr.PageNum] = pr
+	}
+	cm.nodeAddr = snapshot.Members
+	cm.membersVersion = snapshot.MembersVersion
+	cm.recovered = true
+	cm.wal = wal
+	cm.log().Info("Recovered from the write-ahead log", "dir", dir, "pages", len(cm.PageRecords), "nodes", len(cm.nodeAddr))
+	return nil
+}
+
+// snapshot records a change to a page and returns its state for replication. The change is in the
+// log before this returns, if it cannot be logged the caller gets the error and fails what it was
+// doing. pr.lock must be held, so the log has the changes to a page in order
+func (cm *CentralManager) snapshot(pr *PageRecord) (PageRecordState, error) {
+	state := pr.snapshot()
+	return state, cm.logRecord(state)
+}
+
+// logRecord appends the state of a page to the log, if the CM has one. pr.lock must be held
+func (cm *CentralManager) logRecord(state PageRecordState) error {
+	if cm.wal == nil {
+		return nil
+	}
+	if err := cm.wal.Append(walEntry{Record: &state}); err != nil {
+		cm.log().Error("Error logging page", "page", state.PageNum, "err", err)
+		cm.logFailed(err)
+		return fmt.Errorf("logging page %d: %w", state.PageNum, err)
+	}
+	return nil
+}
+
+// logMembers appends the membership to the log, if the CM has one. cm.lock must be held
+func (cm *CentralManager) logMembers() error {
+	if cm.wal == nil {
+		return nil
+	}
+	members, version := cm.members()
+	if err := cm.wal.Append(walEntry{Members: members, MembersVersion: version}); err != nil {
+		cm.log().Error("Error logging membership", "version", version, "err", err)
+		cm.logFailed(err)
+		return fmt.Errorf("logging membership: %w", err)
+	}
+	return nil
+}
+
+// logFailed steps this CM down for good after a change could not be logged. The change is made in
+// memory already, but the CM would come back without it after a restart, so the backups take over
+// once its heartbeats stop, and it never takes over itself. The caller may hold cm.lock or a pr.lock
+func (cm *CentralManager) logFailed(err error) {
+	spawn(cm.transport, func() {
+		cm.lock.Lock()
+		defer cm.lock.Unlock()
+
+		if cm.walFailed {
+			return
+		}
+		cm.walFailed = true
+		if cm.isPrimary {
+			cm.log().Error("Write-ahead log failed, stepping down", "err", err)
+			cm.isPrimary = false
+		}
+	})
+}
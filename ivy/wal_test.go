@@ -0,0 +1,249 @@
+package ivy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// pageEntry is a log entry with a new version of a page record
+func pageEntry(pageNum int, owner int, version int) walEntry {
+	return walEntry{Record: &PageRecordState{PageNum: pageNum, CopySet: []int{}, Owner: owner, Version: version}}
+}
+
+// owners returns the owner of every page in a snapshot
+func owners(snapshot walSnapshot) map[int]int {
+	result := map[int]int{}
+	for _, state := range snapshot.Records {
+		result[state.PageNum] = state.Owner
+	}
+	return result
+}
+
+// reopenWAL closes a log and opens it again, as a CM that restarts does
+func reopenWAL(t *testing.T, wal *WAL) *WAL {
+	t.Helper()
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wal, created, err := OpenWAL(wal.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Fatal("the log was taken for a new one")
+	}
+	t.Cleanup(func() { wal.Close() })
+	return wal
+}
+
+func TestWALReplay(t *testing.T) {
+	freed := pageEntry(1, 1, 2)
+	freed.Record.Freed = true
+
+	tests := []struct {
+		name        string
+		entries     []walEntry
+		cut         string // written after the entries, as by a crash in the middle of an append
+		wantOwners  map[int]int
+		wantMembers int // the membership version
+	}{
+		{
+			name:       "later versions replace earlier ones",
+			entries:    []walEntry{pageEntry(1, 1, 1), pageEntry(1, 2, 2), pageEntry(2, 3, 1)},
+			wantOwners: map[int]int{1: 2, 2: 3},
+		},
+		{
+			name:       "older version is ignored",
+			entries:    []walEntry{pageEntry(1, 2, 2), pageEntry(1, 1, 1)},
+			wantOwners: map[int]int{1: 2},
+		},
+		{
+			name:       "freed page is forgotten",
+			entries:    []walEntry{pageEntry(1, 1, 1), pageEntry(2, 2, 1), freed},
+			wantOwners: map[int]int{2: 2},
+		},
+		{
+			name: "older membership is ignored",
+			entries: []walEntry{
+				{Members: map[int]string{1: "node1", 2: "node2"}, MembersVersion: 2},
+				{Members: map[int]string{1: "node1"}, MembersVersion: 1},
+			},
+			wantOwners:  map[int]int{},
+			wantMembers: 2,
+		},
+		{
+			name:       "cut off last line is dropped",
+			entries:    []walEntry{pageEntry(1, 1, 1), pageEntry(1, 2, 2)},
+			cut:        `{"Record":{"PageNum":1,"CopySet":[],"Owner":3,"Vers`,
+			wantOwners: map[int]int{1: 2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wal, _, err := OpenWAL(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range test.entries {
+				if err := wal.Append(entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.cut != "" {
+				if _, err := wal.file.WriteString(test.cut); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			wal = reopenWAL(t, wal)
+			state := wal.State()
+			if got := owners(state); !reflect.DeepEqual(got, test.wantOwners) {
+				t.Errorf("got owners %v, want %v", got, test.wantOwners)
+			}
+			if state.MembersVersion != test.wantMembers {
+				t.Errorf("got membership version %d, want %d", state.MembersVersion, test.wantMembers)
+			}
+			if wal.entries != len(test.entries) {
+				t.Errorf("replayed %d entries, want %d", wal.entries, len(test.entries))
+			}
+
+			// what is appended after the cut off line is replayed too
+			if err := wal.Append(pageEntry(3, 1, 1)); err != nil {
+				t.Fatal(err)
+			}
+			wal = reopenWAL(t, wal)
+			if owner := owners(wal.State())[3]; owner != 1 {
+				t.Errorf("page 3 is owned by node %d after the next append, want 1", owner)
+			}
+		})
+	}
+}
+
+func TestWALCompaction(t *testing.T) {
+	tests := []struct {
+		name         string
+		appends      int
+		wantEntries  int // entries left in the log
+		wantSnapshot bool
+	}{
+		{name: "short log", appends: walCompactEvery - 1, wantEntries: walCompactEvery - 1},
+		{name: "compacted", appends: walCompactEvery, wantEntries: 0, wantSnapshot: true},
+		{name: "appended to after compaction", appends: walCompactEvery + 5, wantEntries: 5, wantSnapshot: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wal, _, err := OpenWAL(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// three pages handed from node to node
+			wantOwners := map[int]int{}
+			for i := range test.appends {
+				pageNum := 1 + i%3
+				if err := wal.Append(pageEntry(pageNum, i, i+1)); err != nil {
+					t.Fatal(err)
+				}
+				wantOwners[pageNum] = i
+			}
+
+			wal = reopenWAL(t, wal)
+			if wal.entries != test.wantEntries {
+				t.Errorf("the log has %d entries, want %d", wal.entries, test.wantEntries)
+			}
+			_, err = os.Stat(filepath.Join(dir, walSnapshotFile))
+			if hasSnapshot := err == nil; hasSnapshot != test.wantSnapshot {
+				t.Errorf("snapshot written: %v, want %v", hasSnapshot, test.wantSnapshot)
+			}
+			if got := owners(wal.State()); !reflect.DeepEqual(got, wantOwners) {
+				t.Errorf("got owners %v, want %v", got, wantOwners)
+			}
+		})
+	}
+}
+
+// a CM with a log comes back after a restart with the page table and membership it logged, and not
+// with the ones it is configured with
+func TestCMOpenWAL(t *testing.T) {
+	newCM := func() *CentralManager {
+		nodeAddr := map[int]string{1: "node1", 2: "node2"}
+		pageRecords := []*PageRecord{
+			{PageNum: 1, CopySet: []int{}, Owner: 1},
+			{PageNum: 2, CopySet: []int{}, Owner: 2},
+		}
+		return NewCentralManager(0, 0, nodeAddr, pageRecords, map[int]string{0: "cm0"}, 0, NewMemTransport())
+	}
+
+	tests := []struct {
+		name          string
+		restart       bool
+		wantRecovered bool
+		wantOwner     int // of page 1
+		wantCopySet   []int
+		wantNodes     int
+	}{
+		{name: "new log starts from the configuration", wantOwner: 1, wantCopySet: []int{}, wantNodes: 2},
+		{name: "restart recovers the logged changes", restart: true, wantRecovered: true, wantOwner: 2, wantCopySet: []int{1}, wantNodes: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cm := newCM()
+			if err := cm.OpenWAL(dir); err != nil {
+				t.Fatal(err)
+			}
+			if test.restart {
+				pr := cm.findPageRecord(1)
+				pr.lock.Lock()
+				pr.Owner = 2
+				pr.CopySet = []int{1}
+				_, err := cm.snapshot(pr)
+				pr.lock.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cm.lock.Lock()
+				cm.nodeAddr[3] = "node3"
+				cm.membersVersion++
+				err = cm.logMembers()
+				cm.lock.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				cm.wal.Close()
+				cm = newCM()
+				if err := cm.OpenWAL(dir); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Cleanup(func() { cm.wal.Close() })
+
+			if cm.recovered != test.wantRecovered {
+				t.Errorf("recovered: %v, want %v", cm.recovered, test.wantRecovered)
+			}
+			pr := cm.findPageRecord(1)
+			if pr == nil {
+				t.Fatal("page 1 is not on record")
+			}
+			if pr.Owner != test.wantOwner || !reflect.DeepEqual(pr.CopySet, test.wantCopySet) {
+				t.Errorf("page 1 is owned by node %d with copies on %v, want node %d with copies on %v", pr.Owner, pr.CopySet, test.wantOwner, test.wantCopySet)
+			}
+			if cm.findPageRecord(2) == nil {
+				t.Error("page 2 is not on record")
+			}
+			if len(cm.nodeAddr) != test.wantNodes {
+				t.Errorf("got %d nodes, want %d", len(cm.nodeAddr), test.wantNodes)
+			}
+			for id, address := range cm.nodeAddr {
+				if address != "node"+strconv.Itoa(id) {
+					t.Errorf("node %d has address %q", id, address)
+				}
+			}
+		})
+	}
+}